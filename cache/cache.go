@@ -0,0 +1,104 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package cache keeps rendered images for reuse by identical requests,
+// in memory or on disk, evicting the least recently used entries beyond a size limit.
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// Cache stores values by key. Implementations are safe for concurrent use.
+type Cache interface {
+	// Get returns the value stored for key, false if there is none or it expired
+	Get(key string) ([]byte, bool)
+	// Set stores value for key, replacing any previous value
+	Set(key string, value []byte)
+}
+
+// Key builds a cache key from the parts identifying a request. Parts can hold secrets, e.g. api tokens,
+// as the key is a hash of them.
+func Key(parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type entry struct {
+	key    string
+	size   int64
+	stored time.Time
+	value  []byte //nil for entries kept on disk
+}
+
+// lru orders entries by their last use, evicting the least recently used beyond maxSize bytes
+type lru struct {
+	maxSize int64
+	size    int64
+	order   *list.List //most recently used first
+	entries map[string]*list.Element
+}
+
+func newLRU(maxSize int64) *lru {
+	return &lru{maxSize: maxSize, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// get returns the entry for key, marking it as used
+func (l *lru) get(key string) (*entry, bool) {
+	el, ok := l.entries[key]
+	if !ok {
+		return nil, false
+	}
+	l.order.MoveToFront(el)
+	return el.Value.(*entry), true
+}
+
+// put adds e as the most recently used entry and returns the entries evicted to make space for it
+func (l *lru) put(e *entry) []*entry {
+	l.remove(e.key)
+	l.entries[e.key] = l.order.PushFront(e)
+	l.size += e.size
+	var evicted []*entry
+	for l.size > l.maxSize && l.order.Len() > 1 {
+		old := l.order.Back().Value.(*entry)
+		l.remove(old.key)
+		evicted = append(evicted, old)
+	}
+	return evicted
+}
+
+// remove drops the entry for key, if any
+func (l *lru) remove(key string) {
+	el, ok := l.entries[key]
+	if !ok {
+		return
+	}
+	l.order.Remove(el)
+	delete(l.entries, key)
+	l.size -= el.Value.(*entry).size
+}
+
+// expired reports whether an entry stored at stored is older than ttl. A ttl of 0 never expires.
+func expired(stored time.Time, ttl time.Duration) bool {
+	return ttl > 0 && time.Since(stored) > ttl
+}
@@ -0,0 +1,149 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestKey(t *testing.T) {
+	Convey("When building cache keys", t, func() {
+		Convey("Equal parts should give equal keys", func() {
+			So(Key("a", "b"), ShouldEqual, Key("a", "b"))
+		})
+
+		Convey("The parts should not run into each other", func() {
+			So(Key("ab", "c"), ShouldNotEqual, Key("a", "bc"))
+		})
+
+		Convey("The key should not reveal the parts", func() {
+			So(Key("secret-token"), ShouldNotContainSubstring, "secret")
+		})
+	})
+}
+
+// testCache runs the tests shared by all cache implementations against caches made by newCache
+func testCache(newCache func(maxSize int64, ttl time.Duration) Cache) {
+	Convey("It should return the stored values", func() {
+		c := newCache(10, 0)
+		c.Set("a", []byte("123"))
+		v, ok := c.Get("a")
+		So(ok, ShouldBeTrue)
+		So(string(v), ShouldEqual, "123")
+
+		_, ok = c.Get("b")
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("It should replace stored values", func() {
+		c := newCache(10, 0)
+		c.Set("a", []byte("123"))
+		c.Set("a", []byte("45"))
+		v, _ := c.Get("a")
+		So(string(v), ShouldEqual, "45")
+	})
+
+	Convey("It should evict the least recently used values beyond its size", func() {
+		c := newCache(10, 0)
+		c.Set("a", []byte("1234"))
+		c.Set("b", []byte("1234"))
+		c.Get("a")
+		c.Set("c", []byte("1234"))
+
+		_, ok := c.Get("b")
+		So(ok, ShouldBeFalse)
+		_, ok = c.Get("a")
+		So(ok, ShouldBeTrue)
+		_, ok = c.Get("c")
+		So(ok, ShouldBeTrue)
+	})
+
+	Convey("It should not store values larger than its size", func() {
+		c := newCache(10, 0)
+		c.Set("a", []byte("12345678901"))
+		_, ok := c.Get("a")
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("It should expire values after the ttl", func() {
+		c := newCache(10, 10*time.Millisecond)
+		c.Set("a", []byte("123"))
+		time.Sleep(20 * time.Millisecond)
+		_, ok := c.Get("a")
+		So(ok, ShouldBeFalse)
+	})
+}
+
+func TestMemory(t *testing.T) {
+	Convey("When caching in memory", t, func() {
+		testCache(func(maxSize int64, ttl time.Duration) Cache { return NewMemory(maxSize, ttl) })
+	})
+}
+
+func TestDisk(t *testing.T) {
+	Convey("When caching on disk", t, func() {
+		dir := t.TempDir()
+		newDisk := func(maxSize int64, ttl time.Duration) Cache {
+			d, err := NewDisk(filepath.Join(dir, time.Now().Format("150405.000000000")), maxSize, ttl)
+			So(err, ShouldBeNil)
+			return d
+		}
+		testCache(newDisk)
+
+		Convey("Values should survive reopening the cache", func() {
+			path := filepath.Join(dir, "reopen")
+			d, err := NewDisk(path, 10, 0)
+			So(err, ShouldBeNil)
+			d.Set("a", []byte("123"))
+
+			d, err = NewDisk(path, 10, 0)
+			So(err, ShouldBeNil)
+			v, ok := d.Get("a")
+			So(ok, ShouldBeTrue)
+			So(string(v), ShouldEqual, "123")
+		})
+
+		Convey("Evicted values should be removed from disk", func() {
+			path := filepath.Join(dir, "evict")
+			d, err := NewDisk(path, 4, 0)
+			So(err, ShouldBeNil)
+			d.Set("a", []byte("1234"))
+			d.Set("b", []byte("1234"))
+
+			files, _ := os.ReadDir(path)
+			So(files, ShouldHaveLength, 1)
+		})
+
+		Convey("Files it did not write should be left alone", func() {
+			path := filepath.Join(dir, "foreign")
+			So(os.MkdirAll(path, 0o700), ShouldBeNil)
+			So(os.WriteFile(filepath.Join(path, "notes.txt"), []byte("keep"), 0o600), ShouldBeNil)
+			d, err := NewDisk(path, 4, 0)
+			So(err, ShouldBeNil)
+			d.Set("a", []byte("1234"))
+			d.Set("b", []byte("1234"))
+
+			_, err = os.Stat(filepath.Join(path, "notes.txt"))
+			So(err, ShouldBeNil)
+		})
+	})
+}
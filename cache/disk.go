@@ -0,0 +1,147 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// diskSuffix marks the files of a Disk cache, other files in its directory are left alone
+const diskSuffix = ".cache"
+
+// Disk keeps values as files in a directory, so they survive restarts
+type Disk struct {
+	mu  sync.Mutex
+	dir string
+	lru *lru
+	ttl time.Duration
+}
+
+// NewDisk creates a Cache holding up to maxSize bytes of values as files in dir, each for at most ttl.
+// A ttl of 0 keeps values until they are evicted. Values cached in dir before are picked up.
+func NewDisk(dir string, maxSize int64, ttl time.Duration) (*Disk, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cache directory %v: %v", dir, err)
+	}
+	d := &Disk{dir: dir, lru: newLRU(maxSize), ttl: ttl}
+	err = d.load()
+	if err != nil {
+		return nil, fmt.Errorf("error reading cache directory %v: %v", dir, err)
+	}
+	return d, nil
+}
+
+// load indexes the files cached in the directory, the least recently stored becoming the first evicted
+func (d *Disk) load() error {
+	files, err := os.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+	var entries []*entry
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != diskSuffix {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		name := f.Name()[:len(f.Name())-len(diskSuffix)]
+		entries = append(entries, &entry{key: name, size: info.Size(), stored: info.ModTime()})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].stored.Before(entries[j].stored) })
+	for _, e := range entries {
+		d.evict(d.lru.put(e))
+	}
+	return nil
+}
+
+func (d *Disk) Get(key string) ([]byte, bool) {
+	name := fileName(key)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e, ok := d.lru.get(name)
+	if !ok {
+		return nil, false
+	}
+	if expired(e.stored, d.ttl) {
+		d.lru.remove(name)
+		d.evict([]*entry{e})
+		return nil, false
+	}
+	value, err := os.ReadFile(d.path(name))
+	if err != nil {
+		slog.Warn("error reading cached value", "file", d.path(name), "error", err)
+		d.lru.remove(name)
+		return nil, false
+	}
+	return value, true
+}
+
+func (d *Disk) Set(key string, value []byte) {
+	if int64(len(value)) > d.lru.maxSize {
+		return
+	}
+	name := fileName(key)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	//write to a temporary file first, so readers never see a partly written value
+	tmp, err := os.CreateTemp(d.dir, name+"-*.tmp")
+	if err != nil {
+		slog.Warn("error caching value", "dir", d.dir, "error", err)
+		return
+	}
+	_, err = tmp.Write(value)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), d.path(name))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		slog.Warn("error caching value", "file", d.path(name), "error", err)
+		return
+	}
+	d.evict(d.lru.put(&entry{key: name, size: int64(len(value)), stored: time.Now()}))
+}
+
+// evict removes the files of entries
+func (d *Disk) evict(entries []*entry) {
+	for _, e := range entries {
+		err := os.Remove(d.path(e.key))
+		if err != nil && !os.IsNotExist(err) {
+			slog.Warn("error removing cached value", "file", d.path(e.key), "error", err)
+		}
+	}
+}
+
+func (d *Disk) path(name string) string {
+	return filepath.Join(d.dir, name+diskSuffix)
+}
+
+// fileName returns a name safe to use in the file system for key
+func fileName(key string) string {
+	return Key(key)
+}
@@ -0,0 +1,58 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// Memory keeps values in memory
+type Memory struct {
+	mu  sync.Mutex
+	lru *lru
+	ttl time.Duration
+}
+
+// NewMemory creates a Cache holding up to maxSize bytes of values, each for at most ttl. A ttl of 0 keeps values
+// until they are evicted.
+func NewMemory(maxSize int64, ttl time.Duration) *Memory {
+	return &Memory{lru: newLRU(maxSize), ttl: ttl}
+}
+
+func (m *Memory) Get(key string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.lru.get(key)
+	if !ok {
+		return nil, false
+	}
+	if expired(e.stored, m.ttl) {
+		m.lru.remove(key)
+		return nil, false
+	}
+	return e.value, true
+}
+
+func (m *Memory) Set(key string, value []byte) {
+	if int64(len(value)) > m.lru.maxSize {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lru.put(&entry{key: key, size: int64(len(value)), stored: time.Now(), value: value})
+}
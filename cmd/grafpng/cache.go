@@ -0,0 +1,130 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"grafpng/cache"
+	"grafpng/grafana"
+	"grafpng/metrics"
+
+	"github.com/gorilla/mux"
+)
+
+// cacheHeader tells whether a report was served from the cache
+const cacheHeader = "X-Cache"
+
+// renderCache keeps rendered panels and reports, set up in main. Nil disables caching.
+var renderCache cache.Cache
+
+// newCache creates the cache selected by the -cache flags: none, memory or disk
+func newCache(kind, dir string, sizeMB int64, ttl time.Duration) (cache.Cache, error) {
+	switch kind {
+	case "", "none":
+		return nil, nil
+	case "memory":
+		return cache.NewMemory(sizeMB<<20, ttl), nil
+	case "disk":
+		return cache.NewDisk(dir, sizeMB<<20, ttl)
+	}
+	return nil, fmt.Errorf("unknown cache %q: must be none, memory or disk", kind)
+}
+
+// bypassCache reports whether the request asks to render afresh with the nocache query parameter
+func bypassCache(req *http.Request) bool {
+	return req.URL.Query().Has("nocache")
+}
+
+// panelCacheOptions returns how panels rendered for the request are cached
+func panelCacheOptions(req *http.Request) grafana.CacheOptions {
+	return grafana.CacheOptions{Store: renderCache, Granularity: *cacheGranularity, Refresh: bypassCache(req)}
+}
+
+// cachedReport is a generated report as kept in the cache
+type cachedReport struct {
+	Filename string
+	PNG      []byte
+	ETag     string
+}
+
+// reportCacheKey returns the key caching the report requested, false if the report can not be cached:
+// caching is disabled, the dashboard is posted or the time range is relative without a cache granularity
+func reportCacheKey(req *http.Request) (string, bool) {
+	if renderCache == nil || req.Method != http.MethodGet {
+		return "", false
+	}
+	inst, ok := lookupInstance(mux.Vars(req)["instance"])
+	if !ok {
+		return "", false
+	}
+	t, ok := dashTime(req, inst.Defaults).Rounded(*cacheGranularity)
+	if !ok {
+		return "", false
+	}
+	q := req.URL.Query()
+	q.Del("nocache")
+	q.Set("from", t.From)
+	q.Set("to", t.To)
+	return cache.Key("report", inst.URL, req.URL.Path, q.Encode()), true
+}
+
+// serveCachedReport answers the request with the report cached for key, returning false if there is none
+func serveCachedReport(w http.ResponseWriter, req *http.Request, key string) bool {
+	if bypassCache(req) {
+		metrics.CacheLookups.WithLabelValues("report", "bypass").Inc()
+		return false
+	}
+	data, ok := renderCache.Get(key)
+	if !ok {
+		metrics.CacheLookups.WithLabelValues("report", "miss").Inc()
+		return false
+	}
+	metrics.CacheLookups.WithLabelValues("report", "hit").Inc()
+	var cr cachedReport
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&cr)
+	if err != nil {
+		slog.WarnContext(req.Context(), "error decoding cached report", "error", err)
+		return false
+	}
+	if f := panelFilterParams(req); len(f) > 0 {
+		w.Header().Set(panelFiltersHeader, f.Encode())
+	}
+	if cr.ETag == "" {
+		cr.ETag = etag(cr.PNG)
+	}
+	w.Header().Set(cacheHeader, "HIT")
+	writeReport(w, req, cr.Filename, cr.PNG, cr.ETag)
+	slog.InfoContext(req.Context(), "report served from cache", "filename", cr.Filename)
+	return true
+}
+
+// cacheReport keeps a generated report for key
+func cacheReport(req *http.Request, key string, cr cachedReport) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(cr)
+	if err != nil {
+		slog.WarnContext(req.Context(), "error encoding report for the cache", "error", err)
+		return
+	}
+	renderCache.Set(key, buf.Bytes())
+}
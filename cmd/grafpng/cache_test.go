@@ -0,0 +1,129 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"grafpng/cache"
+	"grafpng/grafana"
+	"grafpng/report"
+
+	"github.com/gorilla/mux"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// pngReport generates the same image each time, counting the generations
+type pngReport struct {
+	mockReport
+	generated *int
+}
+
+func (r pngReport) Generate(ctx context.Context) (io.ReadCloser, error) {
+	*r.generated++
+	return io.NopCloser(strings.NewReader("png")), nil
+}
+
+func TestReportCache(t *testing.T) {
+	Convey("When reports are cached", t, func() {
+		defer func() { renderCache = nil }()
+		renderCache = cache.NewMemory(1<<20, 0)
+
+		generated := 0
+		newReport := func(g grafana.Client, dashName string, _ grafana.TimeRange, worker int, opts report.Options) report.Report {
+			return pngReport{generated: &generated}
+		}
+		router := mux.NewRouter()
+		RegisterHandlers(router, ServeReportHandler{nil, nil}, ServeReportHandler{grafana.NewV5Client, newReport}, ServeReportHandler{nil, nil})
+		get := func(url string) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", url, nil)
+			router.ServeHTTP(rec, req)
+			return rec
+		}
+
+		Convey("An identical request should be served from the cache", func() {
+			first := get("/api/v5/report/testDash?from=1500000000000&to=1500003600000&var-host=web1")
+			So(first.Header().Get(cacheHeader), ShouldEqual, "MISS")
+			second := get("/api/v5/report/testDash?var-host=web1&to=1500003600000&from=1500000000000")
+			So(second.Code, ShouldEqual, http.StatusOK)
+			So(second.Header().Get(cacheHeader), ShouldEqual, "HIT")
+			So(second.Body.String(), ShouldEqual, "png")
+			So(second.Header().Get("Content-Disposition"), ShouldEqual, first.Header().Get("Content-Disposition"))
+			So(generated, ShouldEqual, 1)
+		})
+
+		Convey("Requests for other variable values should not be served from the cache", func() {
+			get("/api/v5/report/testDash?var-host=web1")
+			get("/api/v5/report/testDash?var-host=web2")
+			So(generated, ShouldEqual, 2)
+		})
+
+		Convey("The nocache parameter should bypass the cache", func() {
+			get("/api/v5/report/testDash")
+			rec := get("/api/v5/report/testDash?nocache")
+			So(rec.Header().Get(cacheHeader), ShouldEqual, "MISS")
+			So(generated, ShouldEqual, 2)
+		})
+
+		Convey("Relative time ranges should not be cached without a granularity", func() {
+			defer func(g time.Duration) { *cacheGranularity = g }(*cacheGranularity)
+			*cacheGranularity = 0
+			get("/api/v5/report/testDash?from=now-1h")
+			get("/api/v5/report/testDash?from=now-1h")
+			So(generated, ShouldEqual, 2)
+
+			get("/api/v5/report/testDash?from=1500000000000&to=1500003600000")
+			get("/api/v5/report/testDash?from=1500000000000&to=1500003600000")
+			So(generated, ShouldEqual, 3)
+		})
+
+		Convey("Cached reports should be served while the render queue is full", func() {
+			get("/api/v5/report/testDash?from=1500000000000&to=1500003600000")
+			defer func() { renderLimiter = nil }()
+			renderLimiter = grafana.NewRenderLimiter(0, 0)
+			So(get("/api/v5/report/testDash?from=1500000000000&to=1500003600000").Code, ShouldEqual, http.StatusOK)
+		})
+	})
+}
+
+func TestNewCache(t *testing.T) {
+	Convey("When creating the cache selected by the flags", t, func() {
+		Convey("It should disable caching by default", func() {
+			c, err := newCache("none", "", 1, 0)
+			So(err, ShouldBeNil)
+			So(c, ShouldBeNil)
+		})
+
+		Convey("It should create disk caches in the cache directory", func() {
+			c, err := newCache("disk", t.TempDir(), 1, 0)
+			So(err, ShouldBeNil)
+			So(c, ShouldHaveSameTypeAs, &cache.Disk{})
+		})
+
+		Convey("It should reject unknown caches", func() {
+			_, err := newCache("redis", "", 1, 0)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
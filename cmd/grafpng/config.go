@@ -0,0 +1,175 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"grafpng/grafana"
+)
+
+// config is the service configuration file, describing the Grafana instances reports can be generated from
+type config struct {
+	// Default names the instance used by routes that do not select one.
+	// If empty, the instance given by the -proto and -ip flags is used.
+	Default   string               `json:"default"`
+	Instances map[string]*instance `json:"instances"`
+}
+
+// instance describes a named Grafana instance
+type instance struct {
+	URL      string      `json:"url"`
+	APIToken string      `json:"apiToken"`
+	Username string      `json:"username"`
+	Password string      `json:"password"`
+	OrgID    int         `json:"orgId"`
+	TLS      tlsConfig   `json:"tls"`
+	Defaults defaultsCfg `json:"defaults"`
+
+	httpClient *http.Client
+}
+
+type tlsConfig struct {
+	CAFile             string `json:"caFile"`
+	CertFile           string `json:"certFile"`
+	KeyFile            string `json:"keyFile"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+}
+
+// defaultsCfg holds the request parameters used when a request does not supply them
+type defaultsCfg struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Variables maps template variable names, without the var- prefix, to their values
+	Variables map[string][]string `json:"variables"`
+}
+
+// instances holds the configured Grafana instances by name
+var instances = map[string]*instance{}
+
+// defaultInstance names the instance used by routes that do not select one
+var defaultInstance string
+
+// loadConfig reads the configuration file at path and prepares the http client of every instance
+func loadConfig(path string) (config, error) {
+	var cfg config
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("error reading config file %v: %v", path, err)
+	}
+	err = json.Unmarshal(data, &cfg)
+	if err != nil {
+		return cfg, fmt.Errorf("error parsing config file %v: %v", path, err)
+	}
+	if len(cfg.Instances) == 0 {
+		return cfg, fmt.Errorf("config file %v does not define any instances", path)
+	}
+	if _, ok := cfg.Instances[cfg.Default]; cfg.Default != "" && !ok {
+		return cfg, fmt.Errorf("default instance %q is not defined in config file %v", cfg.Default, path)
+	}
+	for name, inst := range cfg.Instances {
+		if err := inst.init(); err != nil {
+			return cfg, fmt.Errorf("invalid instance %q in config file %v: %v", name, path, err)
+		}
+	}
+	return cfg, nil
+}
+
+func (inst *instance) init() error {
+	u, err := url.Parse(inst.URL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid url %q", inst.URL)
+	}
+	inst.URL = strings.TrimRight(inst.URL, "/")
+
+	tlsCfg, err := inst.TLS.build()
+	if err != nil {
+		return err
+	}
+	if tlsCfg != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsCfg
+		inst.httpClient = &http.Client{Transport: transport}
+	}
+	return nil
+}
+
+// build returns the tls configuration, or nil if the defaults should be used
+func (t tlsConfig) build() (*tls.Config, error) {
+	if t == (tlsConfig{}) {
+		return nil, nil
+	}
+	cfg := &tls.Config{InsecureSkipVerify: t.InsecureSkipVerify}
+	if t.CAFile != "" {
+		pem, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA file: %v", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %v", t.CAFile)
+		}
+	}
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return nil, errors.New("certFile and keyFile must be set together")
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// grafanaConfig returns the client configuration of the instance
+func (inst *instance) grafanaConfig() grafana.Config {
+	return grafana.Config{
+		URL:        inst.URL,
+		APIToken:   inst.APIToken,
+		Username:   inst.Username,
+		Password:   inst.Password,
+		OrgID:      inst.OrgID,
+		HTTPClient: inst.httpClient,
+	}
+}
+
+// flagInstance returns the instance given by the command line flags
+func flagInstance() *instance {
+	return &instance{URL: *proto + *ip, OrgID: *orgID}
+}
+
+// lookupInstance returns the instance called name. The empty name selects the default instance.
+func lookupInstance(name string) (*instance, bool) {
+	if name == "" {
+		name = defaultInstance
+	}
+	if name == "" {
+		return flagInstance(), true
+	}
+	inst, ok := instances[name]
+	return inst, ok
+}
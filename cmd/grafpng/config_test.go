@@ -0,0 +1,92 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func writeConfig(dir, content string) string {
+	path := filepath.Join(dir, "config.json")
+	ioutil.WriteFile(path, []byte(content), 0600)
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	Convey("When loading a configuration file", t, func() {
+		dir, _ := ioutil.TempDir("", "grafpng-config")
+		defer os.RemoveAll(dir)
+
+		Convey("It should parse all named instances", func() {
+			path := writeConfig(dir, `{
+				"default": "prod",
+				"instances": {
+					"prod": {"url": "https://grafana.example.com/", "apiToken": "abc", "orgId": 3,
+						"defaults": {"from": "now-24h", "variables": {"host": ["web1", "web2"]}}},
+					"staging": {"url": "http://staging:3000", "username": "admin", "password": "pw",
+						"tls": {"insecureSkipVerify": true}}
+				}
+			}`)
+			cfg, err := loadConfig(path)
+			So(err, ShouldBeNil)
+			So(cfg.Default, ShouldEqual, "prod")
+			So(cfg.Instances, ShouldHaveLength, 2)
+
+			prod := cfg.Instances["prod"].grafanaConfig()
+			So(prod.URL, ShouldEqual, "https://grafana.example.com")
+			So(prod.APIToken, ShouldEqual, "abc")
+			So(prod.OrgID, ShouldEqual, 3)
+			So(prod.HTTPClient, ShouldBeNil)
+			So(cfg.Instances["prod"].Defaults.From, ShouldEqual, "now-24h")
+			So(cfg.Instances["prod"].Defaults.Variables["host"], ShouldResemble, []string{"web1", "web2"})
+
+			staging := cfg.Instances["staging"].grafanaConfig()
+			So(staging.Username, ShouldEqual, "admin")
+			So(staging.HTTPClient, ShouldNotBeNil)
+		})
+
+		Convey("It should reject a config without instances", func() {
+			_, err := loadConfig(writeConfig(dir, `{"instances": {}}`))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("It should reject an undefined default instance", func() {
+			_, err := loadConfig(writeConfig(dir, `{"default": "prod", "instances": {"staging": {"url": "http://staging:3000"}}}`))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("It should reject instances without a valid url", func() {
+			_, err := loadConfig(writeConfig(dir, `{"instances": {"staging": {"url": "staging:3000"}}}`))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("It should reject a missing CA file", func() {
+			_, err := loadConfig(writeConfig(dir, `{"instances": {"staging": {"url": "https://staging", "tls": {"caFile": "/nonexistent"}}}}`))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("It should reject a missing file", func() {
+			_, err := loadConfig(filepath.Join(dir, "missing.json"))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,64 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// reportCacheControl lets clients keep reports, but revalidate them with the ETag before each use as the
+// dashboard data changes. Reports are private as they are rendered with the caller's credentials.
+const reportCacheControl = "private, no-cache"
+
+// etag returns the entity tag of a report, a hash of its content
+func etag(png []byte) string {
+	sum := sha256.Sum256(png)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// writeReport writes the report png to the response, or answers 304 Not Modified
+// if the client holds it already as told by the If-None-Match header
+func writeReport(w http.ResponseWriter, req *http.Request, filename string, png []byte, tag string) {
+	w.Header().Set("ETag", tag)
+	w.Header().Set("Cache-Control", reportCacheControl)
+	if etagMatches(req.Header.Get("If-None-Match"), tag) {
+		slog.DebugContext(req.Context(), "report not modified", "etag", tag)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	addFilenameHeader(req, w, filename)
+	w.Header().Set("Content-Type", "image/png")
+	_, err := w.Write(png)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "error writing report to response", "error", err)
+	}
+}
+
+// etagMatches reports whether the If-None-Match header value matches tag, comparing weakly as RFC 7232 requires
+func etagMatches(ifNoneMatch, tag string) bool {
+	for _, t := range strings.Split(ifNoneMatch, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"grafpng/cache"
+	"grafpng/grafana"
+	"grafpng/report"
+
+	"github.com/gorilla/mux"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestReportETag(t *testing.T) {
+	Convey("When a report is requested", t, func() {
+		generated := 0
+		newReport := func(g grafana.Client, dashName string, _ grafana.TimeRange, worker int, opts report.Options) report.Report {
+			return pngReport{generated: &generated}
+		}
+		router := mux.NewRouter()
+		RegisterHandlers(router, ServeReportHandler{nil, nil}, ServeReportHandler{grafana.NewV5Client, newReport}, ServeReportHandler{nil, nil})
+		get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/api/v5/report/testDash?from=1500000000000&to=1500003600000", nil)
+			if ifNoneMatch != "" {
+				req.Header.Set("If-None-Match", ifNoneMatch)
+			}
+			router.ServeHTTP(rec, req)
+			return rec
+		}
+
+		Convey("It should send the content hash as ETag", func() {
+			rec := get("")
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(rec.Header().Get("ETag"), ShouldEqual, etag([]byte("png")))
+			So(rec.Header().Get("Cache-Control"), ShouldEqual, reportCacheControl)
+			So(rec.Body.String(), ShouldEqual, "png")
+		})
+
+		Convey("It should answer not modified if the client holds the report", func() {
+			tag := get("").Header().Get("ETag")
+			rec := get(`"other", W/` + tag)
+			So(rec.Code, ShouldEqual, http.StatusNotModified)
+			So(rec.Header().Get("ETag"), ShouldEqual, tag)
+			So(rec.Body.Len(), ShouldEqual, 0)
+		})
+
+		Convey("It should send the report if the client holds another version", func() {
+			rec := get(`"other"`)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(rec.Body.String(), ShouldEqual, "png")
+		})
+
+		Convey("With a report cache, it should answer not modified without generating the report", func() {
+			defer func() { renderCache = nil }()
+			renderCache = cache.NewMemory(1<<20, 0)
+			tag := get("").Header().Get("ETag")
+			rec := get(tag)
+			So(rec.Code, ShouldEqual, http.StatusNotModified)
+			So(rec.Header().Get(cacheHeader), ShouldEqual, "HIT")
+			So(generated, ShouldEqual, 1)
+		})
+	})
+}
+
+func TestETagMatches(t *testing.T) {
+	Convey("When matching If-None-Match headers", t, func() {
+		So(etagMatches(`"abc"`, `"abc"`), ShouldBeTrue)
+		So(etagMatches(`W/"abc"`, `"abc"`), ShouldBeTrue)
+		So(etagMatches(`"x", "abc"`, `"abc"`), ShouldBeTrue)
+		So(etagMatches(`*`, `"abc"`), ShouldBeTrue)
+		So(etagMatches(`"abcd"`, `"abc"`), ShouldBeFalse)
+		So(etagMatches(``, `"abc"`), ShouldBeFalse)
+	})
+}
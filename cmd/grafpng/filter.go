@@ -0,0 +1,101 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"grafpng/report"
+)
+
+// panelFiltersHeader echoes the panel filters a report was generated with
+const panelFiltersHeader = "X-Panel-Filters"
+
+// filterParams names the query parameters of a panel filter
+type filterParams struct {
+	ids, title, types, rows string
+}
+
+var (
+	includeFilterParams = filterParams{"panels", "panel_title", "panel_type", "panel_row"}
+	excludeFilterParams = filterParams{"exclude_panels", "exclude_title", "exclude_type", "exclude_row"}
+)
+
+func (f filterParams) names() []string {
+	return []string{f.ids, f.title, f.types, f.rows}
+}
+
+// panelFilter parses the panel filter named by params from the query parameters.
+// Panel ids and types are comma separated lists, the title is a regular expression and
+// row titles are given by repeating the parameter.
+func panelFilter(r *http.Request, params filterParams) (report.PanelFilter, error) {
+	query := r.URL.Query()
+	var f report.PanelFilter
+	for _, id := range splitList(query[params.ids]) {
+		i, err := strconv.Atoi(id)
+		if err != nil {
+			return f, statusError{http.StatusBadRequest, fmt.Sprintf("invalid %v %q: must be a list of panel ids", params.ids, id)}
+		}
+		f.IDs = append(f.IDs, i)
+	}
+	if t := query.Get(params.title); t != "" {
+		re, err := regexp.Compile(t)
+		if err != nil {
+			return f, statusError{http.StatusBadRequest, fmt.Sprintf("invalid %v %q: %v", params.title, t, err)}
+		}
+		f.Title = re
+	}
+	f.Types = splitList(query[params.types])
+	f.Rows = query[params.rows]
+	if !f.IsEmpty() {
+		slog.DebugContext(r.Context(), "called with panel filter", "exclude", params == excludeFilterParams, "ids", f.IDs, "title", query.Get(params.title), "types", f.Types, "rows", f.Rows)
+	}
+	return f, nil
+}
+
+// panelFilterParams returns the panel filter parameters of the request
+func panelFilterParams(r *http.Request) url.Values {
+	query := r.URL.Query()
+	filters := url.Values{}
+	for _, params := range []filterParams{includeFilterParams, excludeFilterParams} {
+		for _, name := range params.names() {
+			if v, ok := query[name]; ok {
+				filters[name] = v
+			}
+		}
+	}
+	return filters
+}
+
+// splitList splits comma separated parameter values, dropping empty entries
+func splitList(values []string) []string {
+	var list []string
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				list = append(list, s)
+			}
+		}
+	}
+	return list
+}
@@ -17,102 +17,429 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
 
-	"github.com/JaySeek/grafpng/grafana"
-	"github.com/JaySeek/grafpng/report"
+	"grafpng/grafana"
+	"grafpng/logging"
+	"grafpng/metrics"
+	"grafpng/report"
+
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // ServeReportHandler interface facilitates testsing the reportServing http handler
 type ServeReportHandler struct {
-	newGrafanaClient func(url string, apiToken string, variables url.Values) grafana.Client
-	newReport        func(g grafana.Client, dashName string, time grafana.TimeRange, worker int) report.Report
+	newGrafanaClient func(cfg grafana.Config, variables url.Values) grafana.Client
+	newReport        func(g grafana.Client, dashName string, time grafana.TimeRange, worker int, opts report.Options) report.Report
+}
+
+// statusError is an error answered with a specific http status code
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e statusError) Error() string {
+	return e.msg
+}
+
+// httpError logs err and answers the request with it. Errors other than statusError are internal server errors.
+func httpError(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	code := http.StatusInternalServerError
+	if se, ok := err.(statusError); ok {
+		code = se.code
+	} else if errors.Is(err, grafana.ErrRenderQueueFull) {
+		code = http.StatusServiceUnavailable
+		w.Header().Set("Retry-After", renderRetryAfter)
+	} else if errors.Is(err, report.ErrNoPanelsMatch) || errors.Is(err, report.ErrTooManyDashboards) {
+		code = http.StatusBadRequest
+	}
+	slog.ErrorContext(r.Context(), msg, "status", code, "error", err)
+	http.Error(w, err.Error(), code)
 }
 
 // RegisterHandlers registers all http.Handler's with their associated routes to the router
 // Two different serve report handlers are used to provide support for both Grafana v4 (and older) and v5 APIs
-func RegisterHandlers(router *mux.Router, reportServerV4, reportServerV5 ServeReportHandler) {
+// The auto handler serves both, detecting the Grafana version before choosing the API.
+// Reports from the configured Grafana instances are served under /api/v5/{instance}/ and /api/auto/{instance}/
+// Each report route without a dashboard id selects the dashboard by title or tag instead.
+// The panel routes serve the image of a single panel.
+// The snapshot routes report on Grafana snapshots, identified by their key instead of a dashboard id.
+// The job routes generate reports in the background, to be polled for their progress and result.
+// Posting a dashboard definition to a report route reports on it instead of the dashboard saved in Grafana.
+func RegisterHandlers(router *mux.Router, reportServerV4, reportServerV5, reportServerAuto ServeReportHandler) {
 	router.Handle("/api/report/{dashId}", reportServerV4)
 	router.Handle("/api/v5/report/{dashId}", reportServerV5)
+	router.Handle("/api/auto/report/{dashId}", reportServerAuto)
+	router.Handle("/api/v5/{instance}/report/{dashId}", reportServerV5)
+	router.Handle("/api/auto/{instance}/report/{dashId}", reportServerAuto)
+
+	snapshots := ServeReportHandler{grafana.NewSnapshotClient, reportServerV5.newReport}
+	router.Handle("/api/snapshot/report/{dashId}", snapshots)
+	router.Handle("/api/snapshot/{instance}/report/{dashId}", snapshots)
+	router.Handle("/api/snapshot/panel/{dashId}/{panelId}", PanelHandler{grafana.NewSnapshotClient})
+	router.Handle("/api/snapshot/{instance}/panel/{dashId}/{panelId}", PanelHandler{grafana.NewSnapshotClient})
+
+	router.Handle("/api/report", reportServerV4)
+	router.Handle("/api/v5/report", reportServerV5)
+	router.Handle("/api/auto/report", reportServerAuto)
+	router.Handle("/api/v5/{instance}/report", reportServerV5)
+	router.Handle("/api/auto/{instance}/report", reportServerAuto)
+
+	router.Handle("/api/bulk", BulkReportHandler{reportServerV4.newGrafanaClient, report.NewBulkReport})
+	router.Handle("/api/v5/bulk", BulkReportHandler{reportServerV5.newGrafanaClient, report.NewBulkReport})
+	router.Handle("/api/auto/bulk", BulkReportHandler{reportServerAuto.newGrafanaClient, report.NewBulkReport})
+	router.Handle("/api/v5/{instance}/bulk", BulkReportHandler{reportServerV5.newGrafanaClient, report.NewBulkReport})
+	router.Handle("/api/auto/{instance}/bulk", BulkReportHandler{reportServerAuto.newGrafanaClient, report.NewBulkReport})
+
+	router.Handle("/api/panel/{dashId}/{panelId}", PanelHandler{reportServerV4.newGrafanaClient})
+	router.Handle("/api/v5/panel/{dashId}/{panelId}", PanelHandler{reportServerV5.newGrafanaClient})
+	router.Handle("/api/auto/panel/{dashId}/{panelId}", PanelHandler{reportServerAuto.newGrafanaClient})
+	router.Handle("/api/v5/{instance}/panel/{dashId}/{panelId}", PanelHandler{reportServerV5.newGrafanaClient})
+	router.Handle("/api/auto/{instance}/panel/{dashId}/{panelId}", PanelHandler{reportServerAuto.newGrafanaClient})
+
+	router.Handle("/api/v5/jobs", JobHandler{reportServerV5, jobs}).Methods("POST")
+	router.Handle("/api/auto/jobs", JobHandler{reportServerAuto, jobs}).Methods("POST")
+	router.Handle("/api/v5/{instance}/jobs", JobHandler{reportServerV5, jobs}).Methods("POST")
+	router.Handle("/api/auto/{instance}/jobs", JobHandler{reportServerAuto, jobs}).Methods("POST")
+	router.Handle(jobsPath+"{jobId}", JobStatusHandler{jobs}).Methods("GET")
+	router.Handle(jobsPath+"{jobId}/result", JobResultHandler{jobs}).Methods("GET")
+
+	router.Handle("/api/search", SearchHandler{reportServerV4.newGrafanaClient})
+	router.Handle("/api/v5/search", SearchHandler{reportServerV5.newGrafanaClient})
+	router.Handle("/api/auto/search", SearchHandler{reportServerAuto.newGrafanaClient})
+	router.Handle("/api/v5/{instance}/search", SearchHandler{reportServerV5.newGrafanaClient})
+	router.Handle("/api/auto/{instance}/search", SearchHandler{reportServerAuto.newGrafanaClient})
+
+	router.Handle("/healthz", HealthHandler{})
+	router.Handle("/readyz", NewReadyHandler(grafana.CheckHealth, *readyCacheTTL))
+	router.Handle("/metrics", promhttp.Handler())
+	router.Use(metrics.Middleware)
+}
+
+// BulkReportHandler serves one report covering all dashboards matched by a search, e.g. by tag or folder
+type BulkReportHandler struct {
+	newGrafanaClient func(cfg grafana.Config, variables url.Values) grafana.Client
+	newBulkReport    func(g grafana.Client, q grafana.SearchQuery, time grafana.TimeRange, worker int) report.Report
+}
+
+func (h BulkReportHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	slog.InfoContext(ctx, "bulk reporter called", "path", req.URL.Path)
+	key, cacheable := reportCacheKey(req)
+	if cacheable && serveCachedReport(w, req, key) {
+		return
+	}
+	if rejectIfBusy(w, req) {
+		return
+	}
+	inst, cfg, err := clientConfig(req)
+	if err != nil {
+		httpError(w, req, "invalid bulk report request", err)
+		return
+	}
+	q, err := bulkSearchQuery(req)
+	if err != nil {
+		httpError(w, req, "invalid bulk report request", err)
+		return
+	}
+	if q.Query == "" && len(q.Tags) == 0 && len(q.FolderUIDs) == 0 {
+		httpError(w, req, "invalid bulk report request", statusError{http.StatusBadRequest, "a query, tag or folderUIDs is required"})
+		return
+	}
+	gc := limitRenders(h.newGrafanaClient(cfg, dashVariables(req, inst.Defaults.Variables)), req)
+	dt := dashTime(req, inst.Defaults)
+	if err := dt.Validate(); err != nil {
+		httpError(w, req, "invalid bulk report request", statusError{http.StatusBadRequest, err.Error()})
+		return
+	}
+	rep := h.newBulkReport(gc, q, dt, *worker)
+	serveReport(w, req, rep, dt, cfg.OrgID, key)
+}
+
+// clientConfig returns the Grafana instance selected by the request and its client configuration,
+// with the credentials and organisation of the request applied
+func clientConfig(req *http.Request) (*instance, grafana.Config, error) {
+	name := mux.Vars(req)["instance"]
+	inst, ok := lookupInstance(name)
+	if !ok {
+		return nil, grafana.Config{}, statusError{http.StatusNotFound, fmt.Sprintf("unknown grafana instance %q", name)}
+	}
+	cfg := inst.grafanaConfig()
+	if t := apiToken(req); t != "" {
+		cfg.APIToken = t
+	}
+	org, err := dashOrg(req, inst.OrgID)
+	if err != nil {
+		return nil, grafana.Config{}, statusError{http.StatusBadRequest, err.Error()}
+	}
+	cfg.OrgID = org
+	cfg.Cache = panelCacheOptions(req)
+	return inst, cfg, nil
 }
 
 func (h ServeReportHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	log.Print("Reporter called")
-	gc := h.newGrafanaClient(*proto+*ip, apiToken(req), dashVariables(req))
+	slog.InfoContext(req.Context(), "reporter called", "path", logPath(req))
+	key, cacheable := reportCacheKey(req)
+	if cacheable && serveCachedReport(w, req, key) {
+		return
+	}
+	if rejectIfBusy(w, req) {
+		return
+	}
+	pr, ok := h.prepareReport(w, req, nil)
+	if !ok {
+		return
+	}
+	serveReport(w, req, pr.rep, pr.time, pr.org, key)
+}
+
+// preparedReport is a report built from a request, ready to be generated
+type preparedReport struct {
+	rep      report.Report
+	dashName string
+	time     grafana.TimeRange
+	org      int
+}
+
+// prepareReport builds the report selected by the request. progress, if set, counts the panels rendered.
+// If the request is invalid, it is answered with an error and false is returned.
+func (h ServeReportHandler) prepareReport(w http.ResponseWriter, req *http.Request, progress *report.Progress) (preparedReport, bool) {
+	ctx := req.Context()
+	inst, cfg, err := clientConfig(req)
+	if err != nil {
+		httpError(w, req, "invalid report request", err)
+		return preparedReport{}, false
+	}
+	vars := dashVariables(req, inst.Defaults.Variables)
+	gc := h.newGrafanaClient(cfg, vars)
 	di := dashID(req)
-	dt := dashTime(req)
-	rep := h.newReport(gc, di, dt, *worker)
+	posted := req.Method == http.MethodPost && req.ContentLength != 0
+	if posted {
+		gc, di, err = postedDashboard(w, req, gc, vars, di)
+		if err != nil {
+			httpError(w, req, "invalid posted dashboard", err)
+			return preparedReport{}, false
+		}
+	} else if di == "" {
+		di, err = resolveDashboard(ctx, gc, req)
+		if err != nil {
+			httpError(w, req, "error resolving dashboard", err)
+			return preparedReport{}, false
+		}
+	}
+	version, err := positiveInt(req.URL.Query(), "version")
+	if err != nil {
+		httpError(w, req, "invalid report request", err)
+		return preparedReport{}, false
+	}
+	if version > 0 {
+		if posted {
+			httpError(w, req, "invalid report request", statusError{http.StatusBadRequest, "a version can not be requested for a posted dashboard"})
+			return preparedReport{}, false
+		}
+		slog.DebugContext(ctx, "called with dashboard version", "version", version)
+		gc = grafana.NewVersionClient(gc, version)
+	}
+	opts, err := reportOptions(req, vars)
+	if err != nil {
+		httpError(w, req, "invalid report request", err)
+		return preparedReport{}, false
+	}
+	opts.Progress = progress
+	if f := panelFilterParams(req); len(f) > 0 {
+		w.Header().Set(panelFiltersHeader, f.Encode())
+	}
+	dt := dashTime(req, inst.Defaults)
+	if err := dt.Validate(); err != nil {
+		httpError(w, req, "invalid report request", statusError{http.StatusBadRequest, err.Error()})
+		return preparedReport{}, false
+	}
+	gc = limitRenders(gc, req)
+	return preparedReport{h.newReport(gc, di, dt, *worker, opts), di, dt, cfg.OrgID}, true
+}
+
+// maxDashboardSize limits the size of a posted dashboard definition
+const maxDashboardSize = 10 << 20
 
-	file, err := rep.Generate()
+// postedDashboard parses the dashboard definition posted in the request body and wraps gc to report on it
+// instead of fetching the dashboard. Panels are rendered by the dashboard uid of the route, or else of the definition.
+func postedDashboard(w http.ResponseWriter, req *http.Request, gc grafana.Client, vars url.Values, di string) (grafana.Client, string, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxDashboardSize))
 	if err != nil {
-		log.Println("Error generating report:", err)
-		http.Error(w, err.Error(), 500)
-		return
+		return nil, "", statusError{http.StatusBadRequest, fmt.Sprintf("error reading dashboard: %v", err)}
+	}
+	dash, err := grafana.ParseDashboard(body, vars)
+	if err != nil {
+		return nil, "", statusError{http.StatusBadRequest, err.Error()}
+	}
+	if di == "" {
+		di = dash.UID
 	}
+	if di == "" {
+		return nil, "", statusError{http.StatusBadRequest, "the posted dashboard has no uid to render its panels with"}
+	}
+	slog.InfoContext(req.Context(), "reporting on posted dashboard", "title", dash.Title, "dashboard", di, "panels", len(dash.Panels))
+	return grafana.NewStaticDashboardClient(gc, dash), di, nil
+}
+
+// serveReport generates rep and writes it to the response. The report is cached for cacheKey, if set.
+func serveReport(w http.ResponseWriter, req *http.Request, rep report.Report, dt grafana.TimeRange, org int, cacheKey string) {
+	ctx := req.Context()
 	defer rep.Clean()
+	if s, ok := rep.(report.Streamer); ok && streamable(req, cacheKey) {
+		streamReport(w, req, s, rep, dt, org)
+		return
+	}
+	file, err := rep.Generate(ctx)
+	if err != nil {
+		httpError(w, req, "error generating report", err)
+		return
+	}
 	defer file.Close()
-	name := rep.Title() + dt.FromFormatted() + dt.ToFormatted()
-	addFilenameHeader(w, name)
-
-	_, err = io.Copy(w, file)
+	png, err := io.ReadAll(file)
 	if err != nil {
-		log.Println("Error copying data to response:", err)
-		http.Error(w, err.Error(), 500)
+		httpError(w, req, "error reading report", err)
 		return
 	}
-	log.Println("Report generated correctly")
+	filename := reportFilename(rep, dt, org)
+	tag := etag(png)
+	if cacheKey != "" {
+		w.Header().Set(cacheHeader, "MISS")
+		cacheReport(req, cacheKey, cachedReport{filename, png, tag})
+	}
+	writeReport(w, req, filename, png, tag)
+	slog.InfoContext(ctx, "report generated correctly", "title", rep.Title())
+}
+
+// reportFilename names the file of a report by its title, organisation and time range
+func reportFilename(rep report.Report, dt grafana.TimeRange, org int) string {
+	return rep.Title() + orgSuffix(org) + dt.FromFormatted() + dt.ToFormatted()
 }
 
-func addFilenameHeader(w http.ResponseWriter, title string) {
+// reportOptions returns the report options selected by the query parameters:
+// expand={variable} renders one section per requested value of the template variable,
+// the panel filter parameters select the panels rendered
+func reportOptions(r *http.Request, variables url.Values) (report.Options, error) {
+	var opts report.Options
+	if e := r.URL.Query().Get("expand"); e != "" {
+		opts.ExpandVariable = strings.TrimPrefix(e, "var-")
+		opts.ExpandValues = variables["var-"+opts.ExpandVariable]
+		slog.DebugContext(r.Context(), "called with expanded variable", "variable", opts.ExpandVariable)
+	}
+	var err error
+	opts.Include, err = panelFilter(r, includeFilterParams)
+	if err != nil {
+		return opts, err
+	}
+	opts.Exclude, err = panelFilter(r, excludeFilterParams)
+	return opts, err
+}
+
+func addFilenameHeader(r *http.Request, w http.ResponseWriter, title string) {
 	//sanitize title. Http headers should be ASCII
 	filename := strconv.QuoteToASCII(title)
 	filename = strings.TrimLeft(filename, "\"")
 	filename = strings.TrimRight(filename, "\"")
 	filename += ".png"
-	log.Println("Extracted filename from dashboard title: ", filename)
+	slog.DebugContext(r.Context(), "extracted filename from dashboard title", "filename", filename)
 	header := fmt.Sprintf("inline; filename=\"%s\"", filename)
 	w.Header().Add("Content-Disposition", header)
 }
 
+// dashID returns the dashboard id of the route, or else of the dashId query parameter
 func dashID(r *http.Request) string {
 	vars := mux.Vars(r)
 	d := vars["dashId"]
-	log.Println("Called with dashboard:", d)
+	if d == "" {
+		d = r.URL.Query().Get("dashId")
+	}
+	if !isSnapshotRoute(r) {
+		slog.DebugContext(r.Context(), "called with dashboard", "dashboard", d)
+	}
 	return d
 }
 
-func dashTime(r *http.Request) grafana.TimeRange {
+// isSnapshotRoute reports whether r is served by a snapshot route, whose dashboard id is the secret snapshot key
+func isSnapshotRoute(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/snapshot/")
+}
+
+// logPath returns the path of r to log, with the key of the snapshot routes redacted
+func logPath(r *http.Request) string {
+	if isSnapshotRoute(r) {
+		return logging.RedactPathAfter(r.URL.Path, "report", "panel")
+	}
+	return r.URL.Path
+}
+
+func dashTime(r *http.Request, defaults defaultsCfg) grafana.TimeRange {
 	params := r.URL.Query()
-	t := grafana.NewTimeRange(params.Get("from"), params.Get("to"))
-	log.Println("Called with time range:", t)
+	from, to := params.Get("from"), params.Get("to")
+	if from == "" {
+		from = defaults.From
+	}
+	if to == "" {
+		to = defaults.To
+	}
+	t := grafana.NewTimeRange(from, to)
+	slog.DebugContext(r.Context(), "called with time range", "from", t.From, "to", t.To)
 	return t
 }
 
+// dashOrg returns the organisation requested with the orgId query parameter,
+// falling back to the organisation configured for the Grafana instance
+func dashOrg(r *http.Request, defaultOrg int) (int, error) {
+	o := r.URL.Query().Get("orgId")
+	if o == "" {
+		return defaultOrg, nil
+	}
+	org, err := strconv.Atoi(o)
+	if err != nil || org < 1 {
+		return 0, fmt.Errorf("invalid orgId %q: must be a positive integer", o)
+	}
+	slog.DebugContext(r.Context(), "called with organisation", "orgId", org)
+	return org, nil
+}
+
+func orgSuffix(org int) string {
+	if org < 1 {
+		return ""
+	}
+	return "_org" + strconv.Itoa(org)
+}
+
 func apiToken(r *http.Request) string {
 	apiToken := r.URL.Query().Get("apitoken")
-	log.Println("Called with api Token:", apiToken)
+	slog.DebugContext(r.Context(), "called with api token", "present", apiToken != "")
 	return apiToken
 }
 
-func dashVariables(r *http.Request) url.Values {
+// dashVariables returns the template variables of the request. Variables not present
+// in the request are taken from defaults, which maps variable names without the var- prefix to values.
+func dashVariables(r *http.Request, defaults map[string][]string) url.Values {
 	output := url.Values{}
 	for k, v := range r.URL.Query() {
 		if strings.HasPrefix(k, "var-") {
-			log.Println("Called with variable:", k, v)
 			for _, singleV := range v {
 				output.Add(k, singleV)
 			}
 		}
 	}
-	if len(output) == 0 {
-		log.Println("Called without variable")
+	for name, v := range defaults {
+		k := "var-" + name
+		if _, ok := output[k]; !ok {
+			output[k] = append([]string(nil), v...)
+		}
 	}
+	slog.DebugContext(r.Context(), "called with variables", "variables", logging.RedactValues(output).Encode())
 	return output
 }
@@ -18,15 +18,21 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 
-	"github.com/JaySeek/grafpng/grafana"
-	"github.com/JaySeek/grafpng/report"
+	"grafpng/grafana"
+	"grafpng/logging"
+	"grafpng/report"
+
 	"github.com/gorilla/mux"
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -34,7 +40,7 @@ import (
 type mockReport struct {
 }
 
-func (m mockReport) Generate() (pdf io.ReadCloser, err error) {
+func (m mockReport) Generate(ctx context.Context) (pdf io.ReadCloser, err error) {
 	return ioutil.NopCloser(bytes.NewReader(nil)), nil
 }
 
@@ -47,20 +53,20 @@ func TestV4ServeReportHandler(t *testing.T) {
 		//mock new grafana client function to capture and validate its input parameters
 		var clAPIToken string
 		var clVars url.Values
-		newGrafanaClient := func(url string, apiToken string, variables url.Values) grafana.Client {
-			clAPIToken = apiToken
+		newGrafanaClient := func(cfg grafana.Config, variables url.Values) grafana.Client {
+			clAPIToken = cfg.APIToken
 			clVars = variables
-			return grafana.NewV4Client(url, apiToken, variables)
+			return grafana.NewV4Client(cfg, variables)
 		}
 		//mock new report function to capture and validate its input parameters
 		var repDashName string
-		newReport := func(g grafana.Client, dashName string, _ grafana.TimeRange, worker int) report.Report {
+		newReport := func(g grafana.Client, dashName string, _ grafana.TimeRange, worker int, opts report.Options) report.Report {
 			repDashName = dashName
 			return &mockReport{}
 		}
 
 		router := mux.NewRouter()
-		RegisterHandlers(router, ServeReportHandler{newGrafanaClient, newReport}, ServeReportHandler{nil, nil})
+		RegisterHandlers(router, ServeReportHandler{newGrafanaClient, newReport}, ServeReportHandler{nil, nil}, ServeReportHandler{nil, nil})
 		rec := httptest.NewRecorder()
 
 		Convey("It should extract dashboard ID from the URL and forward it to the new reporter ", func() {
@@ -97,21 +103,27 @@ func TestV5ServeReportHandler(t *testing.T) {
 	Convey("When the v5 report server handler is called", t, func() {
 		//mock new grafana client function to capture and validate its input parameters
 		var clAPIToken string
+		var clOrgID int
 		var clVars url.Values
-		newGrafanaClient := func(url string, apiToken string, variables url.Values) grafana.Client {
-			clAPIToken = apiToken
+		var clURL string
+		newGrafanaClient := func(cfg grafana.Config, variables url.Values) grafana.Client {
+			clURL = cfg.URL
+			clAPIToken = cfg.APIToken
+			clOrgID = cfg.OrgID
 			clVars = variables
-			return grafana.NewV4Client(url, apiToken, variables)
+			return grafana.NewV4Client(cfg, variables)
 		}
 		//mock new report function to capture and validate its input parameters
 		var repDashName string
-		newReport := func(g grafana.Client, dashName string, _ grafana.TimeRange, worker int) report.Report {
+		var repOpts report.Options
+		newReport := func(g grafana.Client, dashName string, _ grafana.TimeRange, worker int, opts report.Options) report.Report {
 			repDashName = dashName
+			repOpts = opts
 			return &mockReport{}
 		}
 
 		router := mux.NewRouter()
-		RegisterHandlers(router, ServeReportHandler{nil, nil}, ServeReportHandler{newGrafanaClient, newReport})
+		RegisterHandlers(router, ServeReportHandler{nil, nil}, ServeReportHandler{newGrafanaClient, newReport}, ServeReportHandler{nil, nil})
 		rec := httptest.NewRecorder()
 
 		Convey("It should extract dashboard ID from the URL and forward it to the new reporter ", func() {
@@ -126,6 +138,30 @@ func TestV5ServeReportHandler(t *testing.T) {
 			So(clAPIToken, ShouldEqual, "1234")
 		})
 
+		Convey("It should extract the orgId from the URL and forward it to the new Grafana Client ", func() {
+			req, _ := http.NewRequest("GET", "/api/v5/report/testDash?orgId=4", nil)
+			router.ServeHTTP(rec, req)
+			So(clOrgID, ShouldEqual, 4)
+
+			Convey("The organisation should be part of the report filename", func() {
+				So(rec.Header().Get("Content-Disposition"), ShouldContainSubstring, "title_org4")
+			})
+		})
+
+		Convey("It should use the configured organisation when no orgId is requested", func() {
+			defer func(o int) { *orgID = o }(*orgID)
+			*orgID = 7
+			req, _ := http.NewRequest("GET", "/api/v5/report/testDash", nil)
+			router.ServeHTTP(rec, req)
+			So(clOrgID, ShouldEqual, 7)
+		})
+
+		Convey("It should reject an invalid orgId", func() {
+			req, _ := http.NewRequest("GET", "/api/v5/report/testDash?orgId=abc", nil)
+			router.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusBadRequest)
+		})
+
 		Convey("It should extract the grafana variables and forward them to the new Grafana Client ", func() {
 			req, _ := http.NewRequest("GET", "/api/v5/report/testDash?var-test=testValue", nil)
 			router.ServeHTTP(rec, req)
@@ -141,5 +177,271 @@ func TestV5ServeReportHandler(t *testing.T) {
 				So(clVars, ShouldResemble, expected)
 			})
 		})
+
+		Convey("It should forward the expanded variable and its requested values to the new reporter", func() {
+			req, _ := http.NewRequest("GET", "/api/v5/report/testDash?expand=host&var-host=web1&var-host=web2", nil)
+			router.ServeHTTP(rec, req)
+			So(repOpts.ExpandVariable, ShouldEqual, "host")
+			So(repOpts.ExpandValues, ShouldResemble, []string{"web1", "web2"})
+		})
+
+		Convey("When a dashboard definition is posted", func() {
+			var repClient grafana.Client
+			postReport := func(g grafana.Client, dashName string, _ grafana.TimeRange, worker int, opts report.Options) report.Report {
+				repClient, repDashName = g, dashName
+				return &mockReport{}
+			}
+			router := mux.NewRouter()
+			RegisterHandlers(router, ServeReportHandler{nil, nil}, ServeReportHandler{newGrafanaClient, postReport}, ServeReportHandler{nil, nil})
+
+			Convey("It should report on the posted dashboard, rendered by its uid", func() {
+				body := `{"uid": "ci123", "title": "From CI", "panels": [{"type": "graph", "id": 1}]}`
+				req, _ := http.NewRequest("POST", "/api/v5/report?var-host=web1", strings.NewReader(body))
+				router.ServeHTTP(rec, req)
+				So(rec.Code, ShouldEqual, http.StatusOK)
+				So(repDashName, ShouldEqual, "ci123")
+				dash, err := repClient.GetDashboard(context.Background(), "ci123")
+				So(err, ShouldBeNil)
+				So(dash.Title, ShouldEqual, "From CI")
+				So(dash.Panels, ShouldHaveLength, 1)
+			})
+
+			Convey("The dashboard id of the route should override the uid of the definition", func() {
+				req, _ := http.NewRequest("POST", "/api/v5/report/other", strings.NewReader(`{"dashboard": {"uid": "ci123", "title": "From CI"}}`))
+				router.ServeHTTP(rec, req)
+				So(repDashName, ShouldEqual, "other")
+			})
+
+			Convey("It should reject a version for posted dashboards", func() {
+				req, _ := http.NewRequest("POST", "/api/v5/report?version=2", strings.NewReader(`{"uid": "ci123", "title": "From CI"}`))
+				router.ServeHTTP(rec, req)
+				So(rec.Code, ShouldEqual, http.StatusBadRequest)
+			})
+
+			Convey("It should reject invalid json and definitions without uid", func() {
+				req, _ := http.NewRequest("POST", "/api/v5/report", strings.NewReader(`{"title": `))
+				router.ServeHTTP(rec, req)
+				So(rec.Code, ShouldEqual, http.StatusBadRequest)
+
+				rec = httptest.NewRecorder()
+				req, _ = http.NewRequest("POST", "/api/v5/report", strings.NewReader(`{"title": "No uid"}`))
+				router.ServeHTTP(rec, req)
+				So(rec.Code, ShouldEqual, http.StatusBadRequest)
+			})
+		})
+
+		Convey("It should report on snapshots by their key", func() {
+			req, _ := http.NewRequest("GET", "/api/snapshot/report/s3cr3tk3y", nil)
+			router.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(repDashName, ShouldEqual, "s3cr3tk3y")
+			So(logPath(req), ShouldEqual, "/api/snapshot/report/REDACTED")
+		})
+
+		Convey("It should reject an invalid dashboard version", func() {
+			req, _ := http.NewRequest("GET", "/api/v5/report/testDash?version=latest", nil)
+			router.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("It should forward the panel filters to the new reporter and echo them", func() {
+			req, _ := http.NewRequest("GET", "/api/v5/report/testDash?panels=2,5&panels=7&panel_title=^CPU&exclude_type=text,table&exclude_row=Debug", nil)
+			router.ServeHTTP(rec, req)
+			So(repOpts.Include.IDs, ShouldResemble, []int{2, 5, 7})
+			So(repOpts.Include.Title.String(), ShouldEqual, "^CPU")
+			So(repOpts.Exclude.Types, ShouldResemble, []string{"text", "table"})
+			So(repOpts.Exclude.Rows, ShouldResemble, []string{"Debug"})
+			So(rec.Header().Get("X-Panel-Filters"), ShouldEqual, "exclude_row=Debug&exclude_type=text%2Ctable&panel_title=%5ECPU&panels=2%2C5&panels=7")
+		})
+
+		Convey("It should reject invalid panel filters", func() {
+			req, _ := http.NewRequest("GET", "/api/v5/report/testDash?panels=two", nil)
+			router.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusBadRequest)
+
+			rec = httptest.NewRecorder()
+			req, _ = http.NewRequest("GET", "/api/v5/report/testDash?exclude_title=(", nil)
+			router.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("When a named Grafana instance is requested", func() {
+			defer func() { instances = map[string]*instance{} }()
+			instances = map[string]*instance{
+				"staging": {
+					URL:      "https://staging:3000",
+					APIToken: "instanceToken",
+					OrgID:    2,
+					Defaults: defaultsCfg{Variables: map[string][]string{"host": {"stagingbox"}, "env": {"staging"}}},
+				},
+			}
+
+			Convey("It should use the instance url, credentials and organisation", func() {
+				req, _ := http.NewRequest("GET", "/api/v5/staging/report/testDash", nil)
+				router.ServeHTTP(rec, req)
+				So(repDashName, ShouldEqual, "testDash")
+				So(clURL, ShouldEqual, "https://staging:3000")
+				So(clAPIToken, ShouldEqual, "instanceToken")
+				So(clOrgID, ShouldEqual, 2)
+			})
+
+			Convey("Request parameters should override the instance defaults", func() {
+				req, _ := http.NewRequest("GET", "/api/v5/staging/report/testDash?apitoken=1234&orgId=5&var-host=devbox", nil)
+				router.ServeHTTP(rec, req)
+				So(clAPIToken, ShouldEqual, "1234")
+				So(clOrgID, ShouldEqual, 5)
+				So(clVars.Get("var-host"), ShouldEqual, "devbox")
+				So(clVars.Get("var-env"), ShouldEqual, "staging")
+			})
+
+			Convey("It should return 404 for an unknown instance", func() {
+				req, _ := http.NewRequest("GET", "/api/v5/prod/report/testDash", nil)
+				router.ServeHTTP(rec, req)
+				So(rec.Code, ShouldEqual, http.StatusNotFound)
+			})
+
+			Convey("Routes without an instance should use the configured default instance", func() {
+				defer func() { defaultInstance = "" }()
+				defaultInstance = "staging"
+				req, _ := http.NewRequest("GET", "/api/v5/report/testDash", nil)
+				router.ServeHTTP(rec, req)
+				So(clURL, ShouldEqual, "https://staging:3000")
+			})
+		})
+	})
+}
+
+func TestAutoServeReportHandler(t *testing.T) {
+	Convey("When the auto report server handler is called", t, func() {
+		var clURL string
+		newGrafanaClient := func(cfg grafana.Config, variables url.Values) grafana.Client {
+			clURL = cfg.URL
+			return grafana.NewAutoClient(cfg, variables)
+		}
+		var repDashName string
+		newReport := func(g grafana.Client, dashName string, _ grafana.TimeRange, worker int, opts report.Options) report.Report {
+			repDashName = dashName
+			return &mockReport{}
+		}
+
+		router := mux.NewRouter()
+		RegisterHandlers(router, ServeReportHandler{nil, nil}, ServeReportHandler{nil, nil}, ServeReportHandler{newGrafanaClient, newReport})
+		rec := httptest.NewRecorder()
+
+		Convey("It should extract dashboard ID from the URL and forward it to the new reporter ", func() {
+			req, _ := http.NewRequest("GET", "/api/auto/report/testDash", nil)
+			router.ServeHTTP(rec, req)
+			So(repDashName, ShouldEqual, "testDash")
+		})
+
+		Convey("It should serve reports from named instances", func() {
+			defer func() { instances = map[string]*instance{} }()
+			instances = map[string]*instance{"staging": {URL: "http://staging:3000"}}
+			req, _ := http.NewRequest("GET", "/api/auto/staging/report/testDash", nil)
+			router.ServeHTTP(rec, req)
+			So(repDashName, ShouldEqual, "testDash")
+			So(clURL, ShouldEqual, "http://staging:3000")
+		})
+	})
+}
+
+func TestBulkReportHandler(t *testing.T) {
+	Convey("When the bulk report handler is called", t, func() {
+		var repQuery grafana.SearchQuery
+		var repCalled bool
+		newBulkReport := func(g grafana.Client, q grafana.SearchQuery, _ grafana.TimeRange, worker int) report.Report {
+			repCalled = true
+			repQuery = q
+			return &mockReport{}
+		}
+		router := mux.NewRouter()
+		router.Handle("/api/v5/bulk", BulkReportHandler{grafana.NewV5Client, newBulkReport})
+		rec := httptest.NewRecorder()
+
+		Convey("It should forward the tags and folders to the new bulk report", func() {
+			req, _ := http.NewRequest("GET", "/api/v5/bulk?tag=sla&tag=prod&folderUIDs=f1", nil)
+			router.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(repQuery.Tags, ShouldResemble, []string{"sla", "prod"})
+			So(repQuery.FolderUIDs, ShouldResemble, []string{"f1"})
+			So(rec.Header().Get("Content-Disposition"), ShouldContainSubstring, "title")
+		})
+
+		Convey("It should limit the number of dashboards", func() {
+			req, _ := http.NewRequest("GET", "/api/v5/bulk?tag=sla", nil)
+			router.ServeHTTP(rec, req)
+			So(repQuery.Limit, ShouldEqual, defaultBulkLimit)
+
+			rec = httptest.NewRecorder()
+			req, _ = http.NewRequest("GET", "/api/v5/bulk?tag=sla&limit=1000", nil)
+			repCalled = false
+			router.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusBadRequest)
+			So(repCalled, ShouldBeFalse)
+		})
+
+		Convey("It should answer bad request if more dashboards match than the limit", func() {
+			newBulkReport := func(g grafana.Client, q grafana.SearchQuery, _ grafana.TimeRange, worker int) report.Report {
+				return failingReport{err: fmt.Errorf("%w: more than 20", report.ErrTooManyDashboards)}
+			}
+			router := mux.NewRouter()
+			router.Handle("/api/v5/bulk", BulkReportHandler{grafana.NewV5Client, newBulkReport})
+			req, _ := http.NewRequest("GET", "/api/v5/bulk?tag=sla", nil)
+			router.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("It should refuse to report on all dashboards", func() {
+			req, _ := http.NewRequest("GET", "/api/v5/bulk", nil)
+			router.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusBadRequest)
+			So(repCalled, ShouldBeFalse)
+		})
+	})
+}
+
+func TestServeReportHandlerLogging(t *testing.T) {
+	Convey("When the report server handler is called with credentials and debug logging enabled", t, func() {
+		defer slog.SetDefault(slog.Default())
+		var logs bytes.Buffer
+		So(logging.Setup(&logs, "json", "debug"), ShouldBeNil)
+
+		newGrafanaClient := grafana.NewV5Client
+		newReport := func(g grafana.Client, dashName string, _ grafana.TimeRange, worker int, opts report.Options) report.Report {
+			return &mockReport{}
+		}
+		router := mux.NewRouter()
+		RegisterHandlers(router, ServeReportHandler{nil, nil}, ServeReportHandler{newGrafanaClient, newReport}, ServeReportHandler{nil, nil})
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v5/report/testDash?apitoken=1234&var-db_password=hunter2&var-host=dev", nil)
+		logging.Handler(router).ServeHTTP(rec, req)
+
+		Convey("The api token and sensitive variables should not be logged", func() {
+			So(logs.String(), ShouldNotContainSubstring, "1234")
+			So(logs.String(), ShouldNotContainSubstring, "hunter2")
+			So(logs.String(), ShouldContainSubstring, "var-host=dev")
+		})
+
+		Convey("Log records should carry the request id", func() {
+			So(logs.String(), ShouldContainSubstring, rec.Header().Get(logging.RequestIDHeader))
+		})
+	})
+}
+
+func TestNoPanelsMatch(t *testing.T) {
+	Convey("When the panel filters leave no panel to render", t, func() {
+		newReport := func(g grafana.Client, dashName string, _ grafana.TimeRange, worker int, opts report.Options) report.Report {
+			return failingReport{err: fmt.Errorf("%w of dashboard Ops", report.ErrNoPanelsMatch)}
+		}
+		router := mux.NewRouter()
+		RegisterHandlers(router, ServeReportHandler{nil, nil}, ServeReportHandler{grafana.NewV5Client, newReport}, ServeReportHandler{nil, nil})
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v5/report/testDash?panels=42", nil)
+		router.ServeHTTP(rec, req)
+
+		Convey("It should answer bad request", func() {
+			So(rec.Code, ShouldEqual, http.StatusBadRequest)
+			So(rec.Body.String(), ShouldContainSubstring, "no panels match the panel filters")
+		})
 	})
 }
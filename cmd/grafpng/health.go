@@ -0,0 +1,149 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"grafpng/grafana"
+)
+
+// readyTimeout bounds the time spent checking a Grafana instance
+const readyTimeout = 5 * time.Second
+
+// HealthHandler tells that the process is alive
+type HealthHandler struct{}
+
+func (HealthHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// ReadyHandler tells whether the service can render reports, checking every configured Grafana instance.
+// The service is ready while at least one instance passes its check: the instances are shared by all replicas,
+// so failing on any broken instance would take every replica out of service, also for the instances that work.
+// The result is cached for ttl, so frequent probes do not load Grafana.
+type ReadyHandler struct {
+	check func(ctx context.Context, cfg grafana.Config) error
+	ttl   time.Duration
+
+	mu      sync.Mutex
+	checked time.Time
+	status  readyStatus
+	// running is closed once the check in flight, if any, is done
+	running chan struct{}
+}
+
+// readyStatus is the json answer of the readiness check
+type readyStatus struct {
+	Ready bool `json:"ready"`
+	// Instances maps each Grafana instance to ok, or the error checking it
+	Instances map[string]string `json:"instances"`
+	Checked   time.Time         `json:"checked"`
+}
+
+// NewReadyHandler checks the Grafana instances with check, caching the result for ttl
+func NewReadyHandler(check func(ctx context.Context, cfg grafana.Config) error, ttl time.Duration) *ReadyHandler {
+	return &ReadyHandler{check: check, ttl: ttl}
+}
+
+func (h *ReadyHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if draining.Load() {
+		httpError(w, req, "not ready", statusError{http.StatusServiceUnavailable, "the service is shutting down"})
+		return
+	}
+	status, err := h.readiness(req.Context())
+	if err != nil {
+		httpError(w, req, "readiness check interrupted", statusError{http.StatusServiceUnavailable, err.Error()})
+		return
+	}
+	code := http.StatusOK
+	if !status.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, req, code, status)
+}
+
+// readiness returns the cached readiness, checking the instances again once it is older than ttl.
+// Probes arriving during a check wait for it. The check runs detached from the probe, so a probe that
+// gives up early does not fail the check, and its result is cached for the following probes.
+func (h *ReadyHandler) readiness(ctx context.Context) (readyStatus, error) {
+	h.mu.Lock()
+	if !h.checked.IsZero() && time.Since(h.checked) < h.ttl {
+		defer h.mu.Unlock()
+		return h.status, nil
+	}
+	if h.running == nil {
+		h.running = make(chan struct{})
+		go h.refresh(context.WithoutCancel(ctx), h.running)
+	}
+	running := h.running
+	h.mu.Unlock()
+
+	select {
+	case <-running:
+	case <-ctx.Done():
+		return readyStatus{}, fmt.Errorf("readiness check not finished: %v", ctx.Err())
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.status, nil
+}
+
+// refresh checks all instances at the same time, caches the result and closes running
+func (h *ReadyHandler) refresh(ctx context.Context, running chan struct{}) {
+	status := readyStatus{Instances: map[string]string{}, Checked: time.Now()}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, inst := range readyInstances() {
+		wg.Add(1)
+		go func(name string, cfg grafana.Config) {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, readyTimeout)
+			defer cancel()
+			err := h.check(checkCtx, cfg)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				slog.WarnContext(ctx, "grafana instance not ready", "instance", name, "error", err)
+				status.Instances[name] = err.Error()
+				return
+			}
+			status.Ready = true
+			status.Instances[name] = "ok"
+		}(name, inst.grafanaConfig())
+	}
+	wg.Wait()
+
+	h.mu.Lock()
+	h.checked, h.status, h.running = status.Checked, status, nil
+	h.mu.Unlock()
+	close(running)
+}
+
+// readyInstances returns the Grafana instances reports are served from: the configured instances,
+// or else the instance given by the command line flags
+func readyInstances() map[string]*instance {
+	if len(instances) > 0 {
+		return instances
+	}
+	return map[string]*instance{"default": flagInstance()}
+}
@@ -0,0 +1,145 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"grafpng/grafana"
+
+	"github.com/gorilla/mux"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestHealthHandlers(t *testing.T) {
+	Convey("When the health endpoints are called", t, func() {
+		defer func() { instances = map[string]*instance{} }()
+		instances = map[string]*instance{"prod": {URL: "http://prod"}, "staging": {URL: "http://staging"}}
+		var mu sync.Mutex
+		checks := 0
+		down := map[string]bool{}
+		check := func(ctx context.Context, cfg grafana.Config) error {
+			mu.Lock()
+			defer mu.Unlock()
+			checks++
+			if down[cfg.URL] {
+				return errors.New("connection refused")
+			}
+			return nil
+		}
+		ready := NewReadyHandler(check, time.Minute)
+		get := func(h http.Handler, path string) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", path, nil)
+			h.ServeHTTP(rec, req)
+			return rec
+		}
+
+		Convey("The liveness check should always pass", func() {
+			router := mux.NewRouter()
+			RegisterHandlers(router, ServeReportHandler{nil, nil}, ServeReportHandler{nil, nil}, ServeReportHandler{nil, nil})
+			So(get(router, "/healthz").Code, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("The service should be ready when all instances pass their check", func() {
+			rec := get(ready, "/readyz")
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			var status readyStatus
+			So(json.Unmarshal(rec.Body.Bytes(), &status), ShouldBeNil)
+			So(status.Ready, ShouldBeTrue)
+			So(status.Instances, ShouldResemble, map[string]string{"prod": "ok", "staging": "ok"})
+		})
+
+		Convey("The service should stay ready when one instance fails its check", func() {
+			down["http://staging"] = true
+			rec := get(ready, "/readyz")
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			var status readyStatus
+			So(json.Unmarshal(rec.Body.Bytes(), &status), ShouldBeNil)
+			So(status.Instances["staging"], ShouldContainSubstring, "connection refused")
+		})
+
+		Convey("The service should not be ready when every instance fails its check", func() {
+			down["http://staging"], down["http://prod"] = true, true
+			rec := get(ready, "/readyz")
+			So(rec.Code, ShouldEqual, http.StatusServiceUnavailable)
+			var status readyStatus
+			So(json.Unmarshal(rec.Body.Bytes(), &status), ShouldBeNil)
+			So(status.Ready, ShouldBeFalse)
+		})
+
+		Convey("The result should be cached", func() {
+			get(ready, "/readyz")
+			down["http://prod"] = true
+			So(get(ready, "/readyz").Code, ShouldEqual, http.StatusOK)
+			So(checks, ShouldEqual, 2)
+		})
+
+		Convey("The result should be checked again once expired", func() {
+			ready.ttl = 0
+			get(ready, "/readyz")
+			down["http://prod"], down["http://staging"] = true, true
+			So(get(ready, "/readyz").Code, ShouldEqual, http.StatusServiceUnavailable)
+		})
+	})
+
+	Convey("When a probe gives up before the instances are checked", t, func() {
+		defer func() { instances = map[string]*instance{} }()
+		instances = map[string]*instance{"prod": {URL: "http://prod"}, "staging": {URL: "http://staging"}}
+		release := make(chan struct{})
+		var started sync.WaitGroup
+		started.Add(2)
+		check := func(ctx context.Context, cfg grafana.Config) error {
+			started.Done()
+			select {
+			case <-release:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		ready := NewReadyHandler(check, time.Minute)
+		ctx, cancel := context.WithCancel(context.Background())
+		req, _ := http.NewRequestWithContext(ctx, "GET", "/readyz", nil)
+		rec := httptest.NewRecorder()
+		go func() {
+			// both instances are checked at the same time
+			started.Wait()
+			cancel()
+		}()
+		ready.ServeHTTP(rec, req)
+
+		Convey("The probe should not be answered ready", func() {
+			So(rec.Code, ShouldEqual, http.StatusServiceUnavailable)
+		})
+
+		Convey("The check should go on and its result answer the next probe", func() {
+			close(release)
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/readyz", nil)
+			ready.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+		})
+	})
+}
@@ -0,0 +1,374 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"grafpng/logging"
+	"grafpng/report"
+
+	"github.com/gorilla/mux"
+	"github.com/pborman/uuid"
+)
+
+// Job states
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// jobsPath is the route jobs are served at, whichever route they were submitted to
+const jobsPath = "/api/v5/jobs/"
+
+// jobResultPrefix names the result files of jobs in the temp root, so results left behind by a crash are swept
+const jobResultPrefix = "grafpng-job-"
+
+// jobs runs the reports submitted to the job routes, set up in main
+var jobs *jobQueue
+
+// job is a report generated in the background
+type job struct {
+	mu       sync.Mutex
+	id       string
+	ctx      context.Context
+	report   preparedReport
+	progress *report.Progress
+	state    string
+	err      string
+	title    string
+	result   string
+	created  time.Time
+	started  time.Time
+	finished time.Time
+}
+
+// jobStatus describes a job to the clients polling it
+type jobStatus struct {
+	ID        string                `json:"id"`
+	State     string                `json:"state"`
+	Dashboard string                `json:"dashboard"`
+	Title     string                `json:"title,omitempty"`
+	Progress  report.ProgressStatus `json:"progress"`
+	Error     string                `json:"error,omitempty"`
+	Result    string                `json:"result,omitempty"`
+	Created   time.Time             `json:"created"`
+	Started   *time.Time            `json:"started,omitempty"`
+	Finished  *time.Time            `json:"finished,omitempty"`
+}
+
+func (j *job) status() jobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	s := jobStatus{
+		ID:        j.id,
+		State:     j.state,
+		Dashboard: j.report.dashName,
+		Title:     j.title,
+		Progress:  j.progress.Status(),
+		Error:     j.err,
+		Created:   j.created,
+	}
+	if !j.started.IsZero() {
+		s.Started = &j.started
+	}
+	if !j.finished.IsZero() {
+		s.Finished = &j.finished
+	}
+	if j.state == jobDone {
+		s.Result = jobsPath + j.id + "/result"
+	}
+	return s
+}
+
+// jobQueue runs jobs on a fixed number of workers and keeps finished jobs for the retention period
+type jobQueue struct {
+	mu        sync.Mutex
+	ctx       context.Context
+	jobs      map[string]*job
+	pending   chan *job
+	retention time.Duration
+	closed    bool
+	active    sync.WaitGroup //jobs queued or running
+}
+
+// newJobQueue starts workers running jobs. At most size jobs wait for a worker.
+// Jobs are generated with ctx, cancelling it cancels the running jobs.
+func newJobQueue(ctx context.Context, workers, size int, retention time.Duration) *jobQueue {
+	q := &jobQueue{
+		ctx:       ctx,
+		jobs:      make(map[string]*job),
+		pending:   make(chan *job, size),
+		retention: retention,
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for j := range q.pending {
+				q.run(j)
+			}
+		}()
+	}
+	return q
+}
+
+// submit queues j, returning false if the queue is full or shut down
+func (q *jobQueue) submit(j *job) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false
+	}
+	select {
+	case q.pending <- j:
+		q.jobs[j.id] = j
+		q.active.Add(1)
+		return true
+	default:
+		return false
+	}
+}
+
+// shutdown stops accepting jobs and fails the jobs still queued, then waits for the running jobs until ctx is done
+func (q *jobQueue) shutdown(ctx context.Context) error {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	return waitFor(ctx, &q.active)
+}
+
+// isClosed reports whether the queue is shut down
+func (q *jobQueue) isClosed() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.closed
+}
+
+func (q *jobQueue) get(id string) (*job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j, ok := q.jobs[id]
+	return j, ok
+}
+
+func (q *jobQueue) run(j *job) {
+	defer q.active.Done()
+	if q.isClosed() {
+		j.report.rep.Clean()
+		j.mu.Lock()
+		j.state, j.err, j.finished = jobFailed, "the service shut down before the job started", time.Now()
+		j.mu.Unlock()
+		return
+	}
+	j.mu.Lock()
+	j.state, j.started = jobRunning, time.Now()
+	j.mu.Unlock()
+	slog.InfoContext(j.ctx, "running report job", "job", j.id, "dashboard", j.report.dashName)
+	defer func() {
+		//a panicking report must not take the service down with it
+		if r := recover(); r != nil {
+			slog.ErrorContext(j.ctx, "report job panicked", "job", j.id, "panic", r, "stack", string(debug.Stack()))
+			j.mu.Lock()
+			j.state, j.err, j.finished = jobFailed, fmt.Sprintf("error generating report: %v", r), time.Now()
+			j.mu.Unlock()
+		}
+	}()
+
+	title, result, err := j.generate()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.finished = time.Now()
+	if err != nil {
+		slog.ErrorContext(j.ctx, "report job failed", "job", j.id, "error", err)
+		j.state, j.err = jobFailed, err.Error()
+		return
+	}
+	slog.InfoContext(j.ctx, "report job done", "job", j.id, "title", title, "duration", j.finished.Sub(j.started))
+	j.state, j.title, j.result = jobDone, title, result
+}
+
+// generate generates the report of j into a result file kept until the job expires
+func (j *job) generate() (string, string, error) {
+	rep := j.report.rep
+	defer rep.Clean()
+	file, err := rep.Generate(j.ctx)
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+
+	out, err := os.CreateTemp(report.TempRoot(), jobResultPrefix+"*.png")
+	if err != nil {
+		return "", "", fmt.Errorf("error creating job result file: %v", err)
+	}
+	defer out.Close()
+	_, err = io.Copy(out, file)
+	if err != nil {
+		os.Remove(out.Name())
+		return "", "", fmt.Errorf("error copying report to job result file: %v", err)
+	}
+	return reportFilename(rep, j.report.time, j.report.org), out.Name(), nil
+}
+
+// sweep removes the jobs finished longer than the retention period before now, with their results
+func (q *jobQueue) sweep(now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for id, j := range q.jobs {
+		j.mu.Lock()
+		expired := !j.finished.IsZero() && now.Sub(j.finished) > q.retention
+		result := j.result
+		j.mu.Unlock()
+		if !expired {
+			continue
+		}
+		if result != "" {
+			if err := os.Remove(result); err != nil {
+				slog.Error("error removing job result", "job", id, "error", err)
+			}
+		}
+		delete(q.jobs, id)
+		slog.Debug("expired report job", "job", id)
+	}
+}
+
+// removeResults removes the results of all jobs, as they are lost with the service
+func (q *jobQueue) removeResults() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for id, j := range q.jobs {
+		j.mu.Lock()
+		if j.result != "" {
+			if err := os.Remove(j.result); err != nil {
+				slog.Error("error removing job result", "job", id, "error", err)
+			}
+			j.result = ""
+		}
+		j.mu.Unlock()
+	}
+}
+
+// sweepEvery sweeps the queue at every interval
+func (q *jobQueue) sweepEvery(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		q.sweep(now)
+	}
+}
+
+// JobHandler queues a report job, answering with its status
+type JobHandler struct {
+	reports ServeReportHandler
+	queue   *jobQueue
+}
+
+func (h JobHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	slog.InfoContext(ctx, "report job submitted", "path", req.URL.Path)
+	j := &job{
+		id:       uuid.New(),
+		ctx:      logging.WithRequestID(h.queue.ctx, logging.RequestID(ctx)),
+		progress: &report.Progress{},
+		state:    jobQueued,
+		created:  time.Now(),
+	}
+	var ok bool
+	j.report, ok = h.reports.prepareReport(w, req, j.progress)
+	if !ok {
+		return
+	}
+	if !h.queue.submit(j) {
+		j.report.rep.Clean()
+		msg := "too many report jobs are waiting, retry later"
+		if h.queue.isClosed() {
+			msg = "the service is shutting down"
+		}
+		httpError(w, req, "report job rejected", statusError{http.StatusServiceUnavailable, msg})
+		return
+	}
+	w.Header().Set("Location", jobsPath+j.id)
+	writeJSON(w, req, http.StatusAccepted, j.status())
+}
+
+// JobStatusHandler serves the status of a report job
+type JobStatusHandler struct {
+	queue *jobQueue
+}
+
+func (h JobStatusHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	j, ok := h.queue.get(mux.Vars(req)["jobId"])
+	if !ok {
+		httpError(w, req, "unknown report job", statusError{http.StatusNotFound, "unknown or expired job"})
+		return
+	}
+	writeJSON(w, req, http.StatusOK, j.status())
+}
+
+// JobResultHandler serves the report generated by a job
+type JobResultHandler struct {
+	queue *jobQueue
+}
+
+func (h JobResultHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	j, ok := h.queue.get(mux.Vars(req)["jobId"])
+	if !ok {
+		httpError(w, req, "unknown report job", statusError{http.StatusNotFound, "unknown or expired job"})
+		return
+	}
+	s := j.status()
+	if s.State != jobDone {
+		msg := fmt.Sprintf("job is %v", s.State)
+		if s.Error != "" {
+			msg += ": " + s.Error
+		}
+		httpError(w, req, "report job not done", statusError{http.StatusConflict, msg})
+		return
+	}
+	j.mu.Lock()
+	title, result := j.title, j.result
+	j.mu.Unlock()
+	file, err := os.Open(result)
+	if err != nil {
+		httpError(w, req, "error opening job result", err)
+		return
+	}
+	defer file.Close()
+	w.Header().Set("Content-Type", "image/png")
+	addFilenameHeader(req, w, title)
+	_, err = io.Copy(w, file)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "error copying job result to response", "error", err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, req *http.Request, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "error writing json response", "error", err)
+	}
+}
@@ -0,0 +1,229 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"grafpng/grafana"
+	"grafpng/report"
+
+	"github.com/gorilla/mux"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// jobReport blocks Generate until released
+type jobReport struct {
+	release chan struct{}
+	err     error
+}
+
+func (r jobReport) Generate(ctx context.Context) (io.ReadCloser, error) {
+	<-r.release
+	if r.err != nil {
+		return nil, r.err
+	}
+	return ioutil.NopCloser(strings.NewReader("png")), nil
+}
+
+func (r jobReport) Clean() {}
+
+func (r jobReport) Title() string { return "title" }
+
+// panickingReport panics while generating
+type panickingReport struct {
+	mockReport
+}
+
+func (r panickingReport) Generate(ctx context.Context) (io.ReadCloser, error) {
+	panic("unexpected dashboard")
+}
+
+func jobState(router *mux.Router, location string) (int, jobStatus) {
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", location, nil)
+	router.ServeHTTP(rec, req)
+	var s jobStatus
+	json.Unmarshal(rec.Body.Bytes(), &s)
+	return rec.Code, s
+}
+
+// waitForJob polls the job at location until it is finished
+func waitForJob(router *mux.Router, location string) jobStatus {
+	for i := 0; i < 100; i++ {
+		_, s := jobState(router, location)
+		if s.State == jobDone || s.State == jobFailed {
+			return s
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, s := jobState(router, location)
+	return s
+}
+
+func TestReportJobs(t *testing.T) {
+	Convey("When report jobs are submitted", t, func() {
+		defer func(q *jobQueue) { jobs = q }(jobs)
+		jobs = newJobQueue(context.Background(), 1, 1, time.Hour)
+		rep := jobReport{release: make(chan struct{})}
+		var repDashName string
+		var repProgress *report.Progress
+		newReport := func(g grafana.Client, dashName string, _ grafana.TimeRange, worker int, opts report.Options) report.Report {
+			repDashName, repProgress = dashName, opts.Progress
+			return rep
+		}
+		router := mux.NewRouter()
+		RegisterHandlers(router, ServeReportHandler{nil, nil}, ServeReportHandler{grafana.NewV5Client, newReport}, ServeReportHandler{nil, nil})
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v5/jobs?dashId=testDash&from=now-6h", nil)
+		router.ServeHTTP(rec, req)
+		location := rec.Header().Get("Location")
+
+		Convey("It should accept the job and answer with its status", func() {
+			So(rec.Code, ShouldEqual, http.StatusAccepted)
+			So(location, ShouldStartWith, "/api/v5/jobs/")
+			So(repDashName, ShouldEqual, "testDash")
+			So(repProgress, ShouldNotBeNil)
+			var s jobStatus
+			So(json.Unmarshal(rec.Body.Bytes(), &s), ShouldBeNil)
+			So(s.Dashboard, ShouldEqual, "testDash")
+			So([]string{jobQueued, jobRunning}, ShouldContain, s.State)
+			close(rep.release)
+		})
+
+		Convey("The result should not be served before the job is done", func() {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", location+"/result", nil)
+			router.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusConflict)
+			close(rep.release)
+		})
+
+		Convey("When the job is done", func() {
+			close(rep.release)
+			s := waitForJob(router, location)
+			defer jobs.sweep(time.Now().Add(2 * time.Hour))
+			So(s.State, ShouldEqual, jobDone)
+			So(s.Title, ShouldStartWith, "title")
+			So(s.Finished, ShouldNotBeNil)
+
+			Convey("Its result should be served", func() {
+				rec := httptest.NewRecorder()
+				req, _ := http.NewRequest("GET", s.Result, nil)
+				router.ServeHTTP(rec, req)
+				So(rec.Code, ShouldEqual, http.StatusOK)
+				So(rec.Body.String(), ShouldEqual, "png")
+				So(rec.Header().Get("Content-Disposition"), ShouldContainSubstring, "title")
+			})
+
+			Convey("It should expire after the retention period", func() {
+				jobs.sweep(time.Now().Add(2 * time.Hour))
+				code, _ := jobState(router, location)
+				So(code, ShouldEqual, http.StatusNotFound)
+			})
+		})
+
+		Convey("Unknown jobs should not be found", func() {
+			code, _ := jobState(router, "/api/v5/jobs/"+url.PathEscape("unknown"))
+			So(code, ShouldEqual, http.StatusNotFound)
+			close(rep.release)
+		})
+	})
+
+	Convey("When a report job fails", t, func() {
+		defer func(q *jobQueue) { jobs = q }(jobs)
+		jobs = newJobQueue(context.Background(), 1, 1, time.Hour)
+		rep := jobReport{release: make(chan struct{}), err: errors.New("grafana is down")}
+		close(rep.release)
+		newReport := func(g grafana.Client, dashName string, _ grafana.TimeRange, worker int, opts report.Options) report.Report {
+			return rep
+		}
+		router := mux.NewRouter()
+		RegisterHandlers(router, ServeReportHandler{nil, nil}, ServeReportHandler{grafana.NewV5Client, newReport}, ServeReportHandler{nil, nil})
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v5/jobs?dashId=testDash", nil)
+		router.ServeHTTP(rec, req)
+
+		Convey("Its status should hold the error", func() {
+			s := waitForJob(router, rec.Header().Get("Location"))
+			So(s.State, ShouldEqual, jobFailed)
+			So(s.Error, ShouldContainSubstring, "grafana is down")
+		})
+	})
+
+	Convey("When a report job panics", t, func() {
+		defer func(q *jobQueue) { jobs = q }(jobs)
+		jobs = newJobQueue(context.Background(), 1, 1, time.Hour)
+		newReport := func(g grafana.Client, dashName string, _ grafana.TimeRange, worker int, opts report.Options) report.Report {
+			return panickingReport{}
+		}
+		router := mux.NewRouter()
+		RegisterHandlers(router, ServeReportHandler{nil, nil}, ServeReportHandler{grafana.NewV5Client, newReport}, ServeReportHandler{nil, nil})
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v5/jobs?dashId=testDash", nil)
+		router.ServeHTTP(rec, req)
+
+		Convey("It should fail instead of crashing the service", func() {
+			s := waitForJob(router, rec.Header().Get("Location"))
+			So(s.State, ShouldEqual, jobFailed)
+			So(s.Error, ShouldContainSubstring, "unexpected dashboard")
+		})
+	})
+
+	Convey("When a report job has an invalid time range", t, func() {
+		defer func(q *jobQueue) { jobs = q }(jobs)
+		jobs = newJobQueue(context.Background(), 1, 1, time.Hour)
+		router := mux.NewRouter()
+		RegisterHandlers(router, ServeReportHandler{nil, nil}, ServeReportHandler{grafana.NewV5Client, nil}, ServeReportHandler{nil, nil})
+
+		Convey("It should be rejected as a bad request", func() {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/api/v5/jobs?dashId=testDash&from=yesterday", nil)
+			router.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusBadRequest)
+		})
+	})
+
+	Convey("When the job queue is full", t, func() {
+		defer func(q *jobQueue) { jobs = q }(jobs)
+		jobs = newJobQueue(context.Background(), 0, 1, time.Hour)
+		newReport := func(g grafana.Client, dashName string, _ grafana.TimeRange, worker int, opts report.Options) report.Report {
+			return mockReport{}
+		}
+		router := mux.NewRouter()
+		RegisterHandlers(router, ServeReportHandler{nil, nil}, ServeReportHandler{grafana.NewV5Client, newReport}, ServeReportHandler{nil, nil})
+
+		Convey("New jobs should be rejected", func() {
+			for _, code := range []int{http.StatusAccepted, http.StatusServiceUnavailable} {
+				rec := httptest.NewRecorder()
+				req, _ := http.NewRequest("POST", "/api/v5/jobs?dashId=testDash", nil)
+				router.ServeHTTP(rec, req)
+				So(rec.Code, ShouldEqual, code)
+			}
+		})
+	})
+}
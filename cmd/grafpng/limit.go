@@ -0,0 +1,125 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"grafpng/grafana"
+)
+
+// renderRetryAfter is the number of seconds clients are asked to wait when the render queue is full
+const renderRetryAfter = "10"
+
+// renderLimiter limits the panel renders of all requests together, set up in main. Nil renders without limit.
+var renderLimiter *grafana.RenderLimiter
+
+// limitRenders wraps gc to render within the service wide limit, taking turns with the renders of other callers
+func limitRenders(gc grafana.Client, req *http.Request) grafana.Client {
+	if renderLimiter == nil {
+		return gc
+	}
+	return grafana.NewLimitedClient(gc, renderLimiter, caller(req))
+}
+
+// rejectIfBusy answers the request with 503 Service Unavailable if no more renders can be queued
+func rejectIfBusy(w http.ResponseWriter, req *http.Request) bool {
+	if renderLimiter == nil || !renderLimiter.Full() {
+		return false
+	}
+	httpError(w, req, "render queue full", grafana.ErrRenderQueueFull)
+	return true
+}
+
+// trustedProxies are the networks of the reverse proxies whose X-Forwarded-For header is believed, set up in main
+var trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses a comma separated list of addresses and CIDR networks
+func parseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("error parsing trusted proxy %q: not an address or network", p)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing trusted proxy %q: %v", p, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// caller identifies who a request renders for: the api token if given, or else the client address.
+// The X-Forwarded-For header is only believed from trusted proxies, as clients can set it to anything.
+// The client is then the rightmost address not of a trusted proxy, as proxies append the address they saw.
+func caller(req *http.Request) string {
+	if t := req.URL.Query().Get("apitoken"); t != "" {
+		sum := sha256.Sum256([]byte(t))
+		return "token:" + hex.EncodeToString(sum[:8])
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	if !isTrustedProxy(host) {
+		return "addr:" + host
+	}
+	hops := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		host = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return "addr:" + host
+}
@@ -0,0 +1,135 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"grafpng/grafana"
+	"grafpng/report"
+
+	"github.com/gorilla/mux"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// failingReport fails to generate with err
+type failingReport struct {
+	mockReport
+	err error
+}
+
+func (r failingReport) Generate(ctx context.Context) (io.ReadCloser, error) {
+	return nil, r.err
+}
+
+func TestRenderLimit(t *testing.T) {
+	Convey("When the render queue is full", t, func() {
+		defer func() { renderLimiter = nil }()
+		renderLimiter = grafana.NewRenderLimiter(0, 0)
+
+		generated := false
+		newReport := func(g grafana.Client, dashName string, _ grafana.TimeRange, worker int, opts report.Options) report.Report {
+			generated = true
+			return &mockReport{}
+		}
+		router := mux.NewRouter()
+		RegisterHandlers(router, ServeReportHandler{nil, nil}, ServeReportHandler{grafana.NewV5Client, newReport}, ServeReportHandler{nil, nil})
+
+		for _, path := range []string{"/api/v5/report/testDash", "/api/v5/panel/testDash/2", "/api/v5/bulk?tag=sla"} {
+			Convey(fmt.Sprintf("%s should be rejected with a retry delay", path), func() {
+				rec := httptest.NewRecorder()
+				req, _ := http.NewRequest("GET", path, nil)
+				router.ServeHTTP(rec, req)
+				So(rec.Code, ShouldEqual, http.StatusServiceUnavailable)
+				So(rec.Header().Get("Retry-After"), ShouldEqual, renderRetryAfter)
+				So(generated, ShouldBeFalse)
+			})
+		}
+	})
+
+	Convey("When a report fails as its renders can not be queued", t, func() {
+		newReport := func(g grafana.Client, dashName string, _ grafana.TimeRange, worker int, opts report.Options) report.Report {
+			return failingReport{err: fmt.Errorf("error rendering PNGs: %w", grafana.ErrRenderQueueFull)}
+		}
+		router := mux.NewRouter()
+		RegisterHandlers(router, ServeReportHandler{nil, nil}, ServeReportHandler{grafana.NewV5Client, newReport}, ServeReportHandler{nil, nil})
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v5/report/testDash", nil)
+		router.ServeHTTP(rec, req)
+
+		Convey("It should answer service unavailable", func() {
+			So(rec.Code, ShouldEqual, http.StatusServiceUnavailable)
+			So(rec.Header().Get("Retry-After"), ShouldEqual, renderRetryAfter)
+		})
+	})
+}
+
+func TestCaller(t *testing.T) {
+	Convey("When identifying the caller of a request", t, func() {
+		req, _ := http.NewRequest("GET", "/api/v5/report/testDash", nil)
+		req.RemoteAddr = "10.0.0.1:5000"
+
+		Convey("It should use the client address", func() {
+			So(caller(req), ShouldEqual, "addr:10.0.0.1")
+		})
+
+		Convey("It should ignore the forwarded addresses of untrusted clients", func() {
+			req.Header.Set("X-Forwarded-For", "192.168.1.7")
+			So(caller(req), ShouldEqual, "addr:10.0.0.1")
+		})
+
+		Convey("Behind trusted proxies", func() {
+			defer func() { trustedProxies = nil }()
+			var err error
+			trustedProxies, err = parseTrustedProxies("10.0.0.0/24, 172.16.0.5")
+			So(err, ShouldBeNil)
+
+			Convey("It should use the rightmost forwarded address not of a trusted proxy", func() {
+				req.Header.Set("X-Forwarded-For", "1.2.3.4, 192.168.1.7, 172.16.0.5")
+				So(caller(req), ShouldEqual, "addr:192.168.1.7")
+			})
+
+			Convey("It should read every X-Forwarded-For header", func() {
+				req.Header.Add("X-Forwarded-For", "1.2.3.4")
+				req.Header.Add("X-Forwarded-For", "192.168.1.8")
+				So(caller(req), ShouldEqual, "addr:192.168.1.8")
+			})
+
+			Convey("It should use the proxy address if nothing was forwarded", func() {
+				So(caller(req), ShouldEqual, "addr:10.0.0.1")
+			})
+		})
+
+		Convey("Invalid trusted proxies should be rejected", func() {
+			_, err := parseTrustedProxies("10.0.0.0/33")
+			So(err, ShouldNotBeNil)
+			_, err = parseTrustedProxies("proxy.local")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("It should prefer the api token, without revealing it", func() {
+			req.URL.RawQuery = "apitoken=secret"
+			So(caller(req), ShouldStartWith, "token:")
+			So(caller(req), ShouldNotContainSubstring, "secret")
+		})
+	})
+}
@@ -17,35 +17,138 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"log"
-	"net/http"
+	"log/slog"
+	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"grafpng/grafana"
+	"grafpng/logging"
+	"grafpng/report"
 
 	"github.com/gorilla/mux"
-	"github.com/JaySeek/grafpng/grafana"
-	"github.com/JaySeek/grafpng/report"
 )
 
 var proto = flag.String("proto", "http://", "Grafana Protocol")
 var ip = flag.String("ip", "localhost:3000", "Grafana Address")
 var port = flag.String("port", ":8686", "Service Address")
 var worker = flag.Int("worker", 2, "Service Workers")
+var orgID = flag.Int("org", 0, "Default Grafana organisation ID, 0 uses the organisation of the api token")
+var configFile = flag.String("config", "", "Configuration file describing named Grafana instances")
+var logFormat = flag.String("log-format", "text", "Log output format: text or json")
+var logLevel = flag.String("log-level", "info", "Minimum log level: debug, info, warn or error")
+var renderConcurrency = flag.Int("render-concurrency", 8, "Number of panels rendered at the same time across all requests, 0 for no limit")
+var renderQueue = flag.Int("render-queue", 100, "Number of panel renders waiting for a render slot before requests are rejected")
+var trustedProxiesFlag = flag.String("trusted-proxies", "", "Comma separated addresses or networks of reverse proxies whose X-Forwarded-For header identifies the client")
+var cacheKind = flag.String("cache", "none", "Cache for rendered panels and reports: none, memory or disk")
+var cacheDir = flag.String("cache-dir", filepath.Join(os.TempDir(), "grafpng-cache"), "Directory of the disk cache")
+var cacheSize = flag.Int64("cache-size", 256, "Size limit of the cache in megabytes")
+var cacheTTL = flag.Duration("cache-ttl", 15*time.Minute, "How long rendered panels and reports are cached, 0 until evicted")
+var cacheGranularity = flag.Duration("cache-granularity", time.Minute, "Rounding of the current time when caching relative time ranges, 0 caches absolute time ranges only")
+var readyCacheTTL = flag.Duration("ready-cache", 10*time.Second, "How long the result of the Grafana readiness check is cached")
+var shutdownDelay = flag.Duration("shutdown-delay", 5*time.Second, "How long the readiness check fails on shutdown before the service stops accepting requests")
+var shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "How long reports in flight may take to finish on shutdown before they are cancelled")
+var tmpDir = flag.String("tmp-dir", os.TempDir(), "Directory the temporary files of reports are created in")
+var tmpMaxAge = flag.Duration("tmp-max-age", time.Hour, "Age after which temporary report directories left behind, e.g. by a crash, are removed")
+var tmpSweepInterval = flag.Duration("tmp-sweep-interval", 10*time.Minute, "How often temporary report directories are swept")
+var inMemory = flag.Bool("in-memory", false, "Generate reports in memory without temporary files")
+var jobWorkers = flag.Int("job-workers", 2, "Number of report jobs generated at the same time")
+var jobQueueSize = flag.Int("job-queue", 100, "Number of report jobs waiting to be generated before new jobs are rejected")
+var jobRetention = flag.Duration("job-retention", time.Hour, "How long finished report jobs and their results are kept")
+var logSensitiveVars = flag.String("log-sensitive-vars", logging.DefaultSensitiveVariables, "Regular expression matching template variable names whose values are redacted from logs")
 
 func main() {
 	flag.Parse()
-	log.SetOutput(os.Stdout)
-	log.Printf("serving at '%s' and using grafana at '%s'", *port, *ip)
+	if err := logging.Setup(os.Stdout, *logFormat, *logLevel); err != nil {
+		slog.Error("invalid logging configuration", "error", err)
+		os.Exit(2)
+	}
+	if err := logging.SetSensitiveVariables(*logSensitiveVars); err != nil {
+		slog.Error("invalid logging configuration", "error", err)
+		os.Exit(2)
+	}
+	if *configFile != "" {
+		cfg, err := loadConfig(*configFile)
+		if err != nil {
+			slog.Error("invalid configuration", "error", err)
+			os.Exit(2)
+		}
+		instances = cfg.Instances
+		defaultInstance = cfg.Default
+		for name, inst := range instances {
+			slog.Info("configured grafana instance", "instance", name, "grafana", logging.RedactURL(inst.URL))
+		}
+	}
+	slog.Info("starting service", "port", *port, "grafana", logging.RedactURL(*proto+*ip))
 	w := 1
 	if *worker < 1 {
 		worker = &w
 	}
 
+	if err := report.SetTempRoot(*tmpDir); err != nil {
+		slog.Error("invalid temp directory", "error", err)
+		os.Exit(2)
+	}
+	go sweepTempDirsEvery(*tmpSweepInterval, *tmpMaxAge, *jobRetention)
+	report.SetInMemory(*inMemory)
+	c, err := newCache(*cacheKind, *cacheDir, *cacheSize, *cacheTTL)
+	if err != nil {
+		slog.Error("invalid cache configuration", "error", err)
+		os.Exit(2)
+	}
+	renderCache = c
+	trustedProxies, err = parseTrustedProxies(*trustedProxiesFlag)
+	if err != nil {
+		slog.Error("invalid trusted proxies", "error", err)
+		os.Exit(2)
+	}
+	if *renderConcurrency > 0 {
+		renderLimiter = grafana.NewRenderLimiter(*renderConcurrency, *renderQueue)
+	}
+	if *jobWorkers < 1 {
+		*jobWorkers = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	jobs = newJobQueue(ctx, *jobWorkers, *jobQueueSize, *jobRetention)
+	go jobs.sweepEvery(time.Minute)
+	registerQueueMetrics()
+
 	router := mux.NewRouter()
 	RegisterHandlers(
 		router,
 		ServeReportHandler{grafana.NewV4Client, report.NewReport},
 		ServeReportHandler{grafana.NewV5Client, report.NewReport},
+		ServeReportHandler{grafana.NewAutoClient, report.NewReport},
 	)
-	log.Fatal(http.ListenAndServe(*port, router))
+	ln, err := net.Listen("tcp", *port)
+	if err != nil {
+		slog.Error("error listening", "port", *port, "error", err)
+		os.Exit(1)
+	}
+	stop, _ := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	err = newServer(ctx, cancel, logging.Handler(router), *shutdownDelay, *shutdownTimeout).serve(stop, ln)
+	if err != nil {
+		slog.Error("service stopped", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("service stopped")
+}
+
+// sweepTempDirsEvery removes the temporary report directories older than maxAge now and at every interval,
+// cleaning up after reports that crashed or were killed. Job results are only removed once the job sweeper,
+// running every minute, would have removed them after the job retention, as retained results are still served.
+func sweepTempDirsEvery(interval, maxAge, retention time.Duration) {
+	sweep := func() {
+		report.SweepTempDirs(maxAge)
+		report.SweepTempFiles(jobResultPrefix, max(maxAge, retention+time.Minute))
+	}
+	sweep()
+	for range time.Tick(interval) {
+		sweep()
+	}
 }
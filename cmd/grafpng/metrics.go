@@ -0,0 +1,56 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// registerQueueMetrics exposes the depth of the render and job queues set up in main
+func registerQueueMetrics() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "grafpng",
+		Name:      "render_queue_depth",
+		Help:      "Panel renders waiting for a render slot.",
+	}, func() float64 {
+		if renderLimiter == nil {
+			return 0
+		}
+		return float64(renderLimiter.Queued())
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "grafpng",
+		Name:      "renders_in_flight",
+		Help:      "Panel renders holding a render slot.",
+	}, func() float64 {
+		if renderLimiter == nil {
+			return 0
+		}
+		return float64(renderLimiter.InFlight())
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "grafpng",
+		Name:      "job_queue_depth",
+		Help:      "Report jobs waiting for a worker.",
+	}, func() float64 {
+		if jobs == nil {
+			return 0
+		}
+		return float64(len(jobs.pending))
+	})
+}
@@ -0,0 +1,55 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"grafpng/grafana"
+	"grafpng/report"
+
+	"github.com/gorilla/mux"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	Convey("When the metrics are scraped after a report", t, func() {
+		newReport := func(g grafana.Client, dashName string, _ grafana.TimeRange, worker int, opts report.Options) report.Report {
+			return &mockReport{}
+		}
+		router := mux.NewRouter()
+		RegisterHandlers(router, ServeReportHandler{nil, nil}, ServeReportHandler{grafana.NewV5Client, newReport}, ServeReportHandler{nil, nil})
+		req, _ := http.NewRequest("GET", "/api/v5/report/testDash", nil)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+
+		rec := httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", "/metrics", nil)
+		router.ServeHTTP(rec, req)
+
+		Convey("They should be served in the Prometheus text format", func() {
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(rec.Header().Get("Content-Type"), ShouldStartWith, "text/plain")
+		})
+
+		Convey("They should count the report by its route and status", func() {
+			So(rec.Body.String(), ShouldContainSubstring, `grafpng_http_requests_total{code="200",route="/api/v5/report/{dashId}"}`)
+			So(rec.Body.String(), ShouldContainSubstring, `grafpng_http_request_duration_seconds_bucket{route="/api/v5/report/{dashId}"`)
+		})
+	})
+}
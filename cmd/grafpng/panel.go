@@ -0,0 +1,162 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"grafpng/grafana"
+
+	"github.com/gorilla/mux"
+)
+
+// maxRenderScale limits the device scale factor a panel can be requested with
+const maxRenderScale = 4
+
+// maxRenderWidth and maxRenderHeight limit the size in pixels a panel can be requested with,
+// as the renderer allocates the whole image
+const (
+	maxRenderWidth  = 4000
+	maxRenderHeight = 4000
+)
+
+// PanelHandler serves the image of a single dashboard panel
+type PanelHandler struct {
+	newGrafanaClient func(cfg grafana.Config, variables url.Values) grafana.Client
+}
+
+func (h PanelHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	slog.InfoContext(ctx, "panel renderer called", "path", logPath(req))
+	if rejectIfBusy(w, req) {
+		return
+	}
+	inst, cfg, err := clientConfig(req)
+	if err != nil {
+		httpError(w, req, "invalid panel request", err)
+		return
+	}
+	cfg.Render, err = renderOptions(req)
+	if err != nil {
+		httpError(w, req, "invalid panel request", err)
+		return
+	}
+	panelID, err := strconv.Atoi(mux.Vars(req)["panelId"])
+	if err != nil {
+		httpError(w, req, "invalid panel request", statusError{http.StatusBadRequest, fmt.Sprintf("invalid panel id %q", mux.Vars(req)["panelId"])})
+		return
+	}
+
+	gc := limitRenders(h.newGrafanaClient(cfg, dashVariables(req, inst.Defaults.Variables)), req)
+	di := dashID(req)
+	dash, err := gc.GetDashboard(ctx, di)
+	if err != nil {
+		httpError(w, req, "error fetching dashboard", fmt.Errorf("error fetching dashboard %v: %v", di, err))
+		return
+	}
+	p, ok := findPanel(dash, panelID)
+	if !ok {
+		httpError(w, req, "invalid panel request", statusError{http.StatusNotFound, fmt.Sprintf("dashboard %v has no panel %d", di, panelID)})
+		return
+	}
+
+	dt := dashTime(req, inst.Defaults)
+	body, err := gc.GetPanelPng(ctx, p, di, dt)
+	if err != nil {
+		httpError(w, req, "error rendering panel", err)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", "image/png")
+	addFilenameHeader(req, w, fmt.Sprintf("%s_panel%d%s%s%s", dash.Title, panelID, orgSuffix(cfg.OrgID), dt.FromFormatted(), dt.ToFormatted()))
+	_, err = io.Copy(w, body)
+	if err != nil {
+		slog.ErrorContext(ctx, "error copying panel image to response", "error", err)
+		return
+	}
+	slog.InfoContext(ctx, "panel rendered correctly", "title", dash.Title, "panel", panelID)
+}
+
+// findPanel returns the panel with the given id. Repeated panels are rendered
+// with the variable values of the request rather than once per value.
+func findPanel(dash grafana.Dashboard, id int) (grafana.Panel, bool) {
+	for _, p := range dash.Panels {
+		if p.ID == id {
+			p.ScopedVars, p.RenderWidth = nil, 0
+			return p, true
+		}
+	}
+	return grafana.Panel{}, false
+}
+
+// renderOptions returns the render overrides selected by the width, height, scale, theme and tz query parameters
+func renderOptions(r *http.Request) (grafana.RenderOptions, error) {
+	params := r.URL.Query()
+	var opts grafana.RenderOptions
+	var err error
+	if opts.Width, err = renderSize(params, "width", maxRenderWidth); err != nil {
+		return opts, err
+	}
+	if opts.Height, err = renderSize(params, "height", maxRenderHeight); err != nil {
+		return opts, err
+	}
+	if s := params.Get("scale"); s != "" {
+		opts.Scale, err = strconv.ParseFloat(s, 64)
+		if err != nil || opts.Scale <= 0 || opts.Scale > maxRenderScale {
+			return opts, statusError{http.StatusBadRequest, fmt.Sprintf("invalid scale %q: must be a number above 0 and at most %d", s, maxRenderScale)}
+		}
+	}
+	switch t := params.Get("theme"); t {
+	case "", "light", "dark":
+		opts.Theme = t
+	default:
+		return opts, statusError{http.StatusBadRequest, fmt.Sprintf("invalid theme %q: must be light or dark", t)}
+	}
+	opts.Timezone = params.Get("tz")
+	return opts, nil
+}
+
+// renderSize parses the query parameter name as a size of at most max pixels, returning 0 if it is not set
+func renderSize(params url.Values, name string, max int) (int, error) {
+	i, err := positiveInt(params, name)
+	if err != nil {
+		return 0, err
+	}
+	if i > max {
+		return 0, statusError{http.StatusBadRequest, fmt.Sprintf("invalid %v %q: must be at most %d", name, params.Get(name), max)}
+	}
+	return i, nil
+}
+
+// positiveInt parses the query parameter name, returning 0 if it is not set
+func positiveInt(params url.Values, name string) (int, error) {
+	s := params.Get(name)
+	if s == "" {
+		return 0, nil
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil || i < 1 {
+		return 0, statusError{http.StatusBadRequest, fmt.Sprintf("invalid %v %q: must be a positive integer", name, s)}
+	}
+	return i, nil
+}
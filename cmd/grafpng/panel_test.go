@@ -0,0 +1,98 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"grafpng/grafana"
+
+	"github.com/gorilla/mux"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// panelServer fakes the Grafana dashboard and render apis, recording the render request
+func panelServer(renderQuery *url.Values, authHeader *string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/render/") {
+			*renderQuery = r.URL.Query()
+			*authHeader = r.Header.Get("Authorization")
+			fmt.Fprint(w, "png")
+			return
+		}
+		fmt.Fprint(w, `{"dashboard": {"title": "Ops", "panels": [{"type": "singlestat", "id": 2}, {"type": "graph", "id": 3}]}}`)
+	}))
+}
+
+func TestPanelHandler(t *testing.T) {
+	Convey("When the panel handler is called", t, func() {
+		var renderQuery url.Values
+		var authHeader string
+		ts := panelServer(&renderQuery, &authHeader)
+		defer ts.Close()
+		defer func() { instances = map[string]*instance{} }()
+		instances = map[string]*instance{"test": {URL: ts.URL}}
+
+		router := mux.NewRouter()
+		RegisterHandlers(router, ServeReportHandler{nil, nil}, ServeReportHandler{grafana.NewV5Client, nil}, ServeReportHandler{nil, nil})
+		rec := httptest.NewRecorder()
+
+		Convey("It should return the panel image directly", func() {
+			req, _ := http.NewRequest("GET", "/api/v5/test/panel/abc/2?apitoken=1234&var-host=web1", nil)
+			router.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(rec.Body.String(), ShouldEqual, "png")
+			So(rec.Header().Get("Content-Type"), ShouldEqual, "image/png")
+			So(rec.Header().Get("Content-Disposition"), ShouldContainSubstring, "Ops_panel2")
+			So(authHeader, ShouldEqual, "Bearer 1234")
+			So(renderQuery.Get("panelId"), ShouldEqual, "2")
+			So(renderQuery.Get("var-host"), ShouldEqual, "web1")
+			So(renderQuery.Get("height"), ShouldEqual, "200")
+		})
+
+		Convey("It should apply the render overrides", func() {
+			req, _ := http.NewRequest("GET", "/api/v5/test/panel/abc/3?width=1200&height=600&scale=2&theme=dark&tz=Europe/Paris", nil)
+			router.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(renderQuery.Get("width"), ShouldEqual, "1200")
+			So(renderQuery.Get("height"), ShouldEqual, "600")
+			So(renderQuery.Get("scale"), ShouldEqual, "2")
+			So(renderQuery.Get("theme"), ShouldEqual, "dark")
+			So(renderQuery.Get("tz"), ShouldEqual, "Europe/Paris")
+		})
+
+		Convey("It should return 404 for a panel missing from the dashboard", func() {
+			req, _ := http.NewRequest("GET", "/api/v5/test/panel/abc/9", nil)
+			router.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("It should reject invalid overrides", func() {
+			for _, q := range []string{"width=0", "height=tall", "width=100000", "height=4001", "scale=10", "theme=blue"} {
+				rec := httptest.NewRecorder()
+				req, _ := http.NewRequest("GET", "/api/v5/test/panel/abc/3?"+q, nil)
+				router.ServeHTTP(rec, req)
+				So(rec.Code, ShouldEqual, http.StatusBadRequest)
+			}
+		})
+	})
+}
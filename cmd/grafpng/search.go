@@ -0,0 +1,148 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"grafpng/grafana"
+)
+
+// SearchHandler serves the dashboards found by the Grafana search API as json
+type SearchHandler struct {
+	newGrafanaClient func(cfg grafana.Config, variables url.Values) grafana.Client
+}
+
+func (h SearchHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	_, cfg, err := clientConfig(req)
+	if err != nil {
+		httpError(w, req, "invalid search request", err)
+		return
+	}
+	q, err := searchQuery(req)
+	if err != nil {
+		httpError(w, req, "invalid search request", err)
+		return
+	}
+	results, err := h.newGrafanaClient(cfg, url.Values{}).SearchDashboards(ctx, q)
+	if err != nil {
+		httpError(w, req, "error searching dashboards", err)
+		return
+	}
+	if results == nil {
+		results = []grafana.SearchResult{}
+	}
+	slog.InfoContext(ctx, "dashboards searched", "results", len(results))
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(results)
+	if err != nil {
+		slog.ErrorContext(ctx, "error writing search results", "error", err)
+	}
+}
+
+// searchQuery builds a search from the query, tag, folderUIDs, type and limit query parameters
+func searchQuery(r *http.Request) (grafana.SearchQuery, error) {
+	params := r.URL.Query()
+	q := grafana.SearchQuery{
+		Query:      params.Get("query"),
+		Tags:       params["tag"],
+		FolderUIDs: params["folderUIDs"],
+		Type:       params.Get("type"),
+	}
+	if l := params.Get("limit"); l != "" {
+		limit, err := strconv.Atoi(l)
+		if err != nil || limit < 1 {
+			return q, statusError{http.StatusBadRequest, fmt.Sprintf("invalid limit %q: must be a positive integer", l)}
+		}
+		q.Limit = limit
+	}
+	return q, nil
+}
+
+// defaultBulkLimit and maxBulkLimit bound the number of dashboards of a bulk report,
+// as all of them are rendered and stacked into one image in memory
+const (
+	defaultBulkLimit = 20
+	maxBulkLimit     = 50
+)
+
+// bulkSearchQuery builds the search of a bulk report like searchQuery, limited to defaultBulkLimit dashboards
+// unless the limit parameter asks for up to maxBulkLimit
+func bulkSearchQuery(r *http.Request) (grafana.SearchQuery, error) {
+	q, err := searchQuery(r)
+	if err != nil {
+		return q, err
+	}
+	if q.Limit == 0 {
+		q.Limit = defaultBulkLimit
+	}
+	if q.Limit > maxBulkLimit {
+		return q, statusError{http.StatusBadRequest, fmt.Sprintf("invalid limit %d: bulk reports cover at most %d dashboards", q.Limit, maxBulkLimit)}
+	}
+	return q, nil
+}
+
+// resolveDashboard finds the single dashboard selected by the title and tag query parameters.
+// A dashboard whose title matches exactly is preferred over dashboards whose title only contains it.
+func resolveDashboard(ctx context.Context, gc grafana.Client, r *http.Request) (string, error) {
+	params := r.URL.Query()
+	title := params.Get("title")
+	tags := params["tag"]
+	if title == "" && len(tags) == 0 {
+		return "", statusError{http.StatusBadRequest, "a dashboard id, title or tag is required"}
+	}
+
+	results, err := gc.SearchDashboards(ctx, grafana.SearchQuery{Query: title, Tags: tags, Type: grafana.SearchTypeDashboard})
+	if err != nil {
+		return "", fmt.Errorf("error searching dashboards: %v", err)
+	}
+	matches := results
+	if title != "" {
+		var exact []grafana.SearchResult
+		for _, r := range results {
+			if strings.EqualFold(r.Title, title) {
+				exact = append(exact, r)
+			}
+		}
+		if len(exact) > 0 {
+			matches = exact
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", statusError{http.StatusNotFound, "no dashboard matches the requested title and tags"}
+	case 1:
+		slog.InfoContext(ctx, "resolved dashboard", "title", matches[0].Title, "dashboard", matches[0].DashName)
+		return matches[0].DashName, nil
+	default:
+		titles := make([]string, len(matches))
+		for i, m := range matches {
+			titles[i] = m.Title
+		}
+		return "", statusError{http.StatusConflict, fmt.Sprintf("%d dashboards match the requested title and tags: %s", len(matches), strings.Join(titles, ", "))}
+	}
+}
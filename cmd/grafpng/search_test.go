@@ -0,0 +1,127 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"grafpng/grafana"
+	"grafpng/report"
+
+	"github.com/gorilla/mux"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// searchServer fakes the Grafana search api, returning the same results for every search
+func searchServer(results string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, results)
+	}))
+}
+
+func TestSearchHandler(t *testing.T) {
+	Convey("When the search handler is called", t, func() {
+		ts := searchServer(`[{"id":1,"uid":"abc","title":"SLA","type":"dash-db","tags":["sla"]}]`)
+		defer ts.Close()
+		defer func() { instances = map[string]*instance{} }()
+		instances = map[string]*instance{"test": {URL: ts.URL}}
+
+		router := mux.NewRouter()
+		RegisterHandlers(router, ServeReportHandler{grafana.NewV4Client, nil}, ServeReportHandler{grafana.NewV5Client, nil}, ServeReportHandler{nil, nil})
+		rec := httptest.NewRecorder()
+
+		Convey("It should return the search results as json", func() {
+			req, _ := http.NewRequest("GET", "/api/v5/test/search?query=SLA", nil)
+			router.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(rec.Header().Get("Content-Type"), ShouldEqual, "application/json")
+
+			var results []grafana.SearchResult
+			So(json.Unmarshal(rec.Body.Bytes(), &results), ShouldBeNil)
+			So(results, ShouldHaveLength, 1)
+			So(results[0].DashName, ShouldEqual, "abc")
+		})
+
+		Convey("It should reject an invalid limit", func() {
+			req, _ := http.NewRequest("GET", "/api/v5/test/search?limit=none", nil)
+			router.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusBadRequest)
+		})
+	})
+}
+
+func TestReportByTitleOrTag(t *testing.T) {
+	Convey("When a report is requested by title or tag", t, func() {
+		ts := searchServer(`[
+			{"id":1,"uid":"abc","title":"SLA","type":"dash-db","tags":["sla"]},
+			{"id":2,"uid":"def","title":"SLA details","type":"dash-db","tags":["sla"]}
+		]`)
+		defer ts.Close()
+		defer func() { instances = map[string]*instance{} }()
+		instances = map[string]*instance{"test": {URL: ts.URL}}
+
+		var repDashName string
+		newReport := func(g grafana.Client, dashName string, _ grafana.TimeRange, worker int, opts report.Options) report.Report {
+			repDashName = dashName
+			return &mockReport{}
+		}
+		router := mux.NewRouter()
+		RegisterHandlers(router, ServeReportHandler{nil, nil}, ServeReportHandler{grafana.NewV5Client, newReport}, ServeReportHandler{nil, nil})
+		rec := httptest.NewRecorder()
+
+		Convey("It should prefer the dashboard whose title matches exactly", func() {
+			req, _ := http.NewRequest("GET", "/api/v5/test/report?title=sla", nil)
+			router.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(repDashName, ShouldEqual, "abc")
+		})
+
+		Convey("It should refuse a tag matching several dashboards", func() {
+			req, _ := http.NewRequest("GET", "/api/v5/test/report?tag=sla", nil)
+			router.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusConflict)
+			So(repDashName, ShouldBeEmpty)
+		})
+
+		Convey("It should require a title or tag", func() {
+			req, _ := http.NewRequest("GET", "/api/v5/test/report", nil)
+			router.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusBadRequest)
+		})
+	})
+
+	Convey("When no dashboard matches the requested title", t, func() {
+		ts := searchServer(`[]`)
+		defer ts.Close()
+		defer func() { instances = map[string]*instance{} }()
+		instances = map[string]*instance{"test": {URL: ts.URL}}
+
+		router := mux.NewRouter()
+		RegisterHandlers(router, ServeReportHandler{nil, nil}, ServeReportHandler{grafana.NewV5Client, nil}, ServeReportHandler{nil, nil})
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v5/test/report?title=missing", nil)
+		router.ServeHTTP(rec, req)
+
+		Convey("It should answer not found", func() {
+			So(rec.Code, ShouldEqual, http.StatusNotFound)
+		})
+	})
+}
@@ -0,0 +1,126 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cleanupTimeout bounds the wait for cancelled reports to clean up their temporary files
+const cleanupTimeout = 5 * time.Second
+
+// draining is set once the service shuts down, failing the readiness check so no new traffic is routed here
+var draining atomic.Bool
+
+// server serves requests until shut down, then drains the reports in flight
+type server struct {
+	srv      *http.Server
+	cancel   context.CancelFunc //cancels the requests and jobs in flight
+	requests sync.WaitGroup
+	delay    time.Duration
+	timeout  time.Duration
+}
+
+// newServer serves handler with requests derived from ctx. Shutting down keeps serving for delay while the
+// readiness check fails, then waits up to timeout for the reports in flight and cancels the rest with cancel.
+func newServer(ctx context.Context, cancel context.CancelFunc, handler http.Handler, delay, timeout time.Duration) *server {
+	s := &server{cancel: cancel, delay: delay, timeout: timeout}
+	s.srv = &http.Server{
+		Handler:     s.track(handler),
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	return s
+}
+
+// track counts the requests in flight, so shutting down can wait for cancelled requests to clean up
+func (s *server) track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.requests.Add(1)
+		defer s.requests.Done()
+		next.ServeHTTP(w, req)
+	})
+}
+
+// serve serves requests on ln until stop is done, then shuts down: it fails the readiness check for the
+// shutdown delay while still serving, so load balancers stop routing requests here, then stops accepting
+// requests and jobs, waits for the requests and jobs in flight up to the shutdown timeout, and cancels those still running.
+func (s *server) serve(stop context.Context, ln net.Listener) error {
+	errc := make(chan error, 1)
+	go func() { errc <- s.srv.Serve(ln) }()
+	select {
+	case err := <-errc:
+		return err
+	case <-stop.Done():
+	}
+
+	draining.Store(true)
+	if s.delay > 0 {
+		slog.Info("shutting down, failing readiness before draining", "delay", s.delay)
+		select {
+		case err := <-errc:
+			return err
+		case <-time.After(s.delay):
+		}
+	}
+	slog.Info("shutting down, draining reports in flight", "timeout", s.timeout)
+	deadline, cancelDeadline := context.WithTimeout(context.Background(), s.timeout)
+	defer cancelDeadline()
+	err := s.srv.Shutdown(deadline)
+	if jobs != nil {
+		err = errors.Join(err, jobs.shutdown(deadline))
+	}
+	if err != nil {
+		slog.Warn("shutdown timeout reached, cancelling reports in flight", "error", err)
+	}
+	s.cancel()
+
+	cleanup, cancelCleanup := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancelCleanup()
+	if err := waitFor(cleanup, &s.requests); err != nil {
+		slog.Warn("cancelled reports did not finish cleaning up", "error", err)
+	}
+	if jobs != nil {
+		if err := waitFor(cleanup, &jobs.active); err != nil {
+			slog.Warn("cancelled report jobs did not finish cleaning up", "error", err)
+		}
+		jobs.removeResults()
+	}
+	s.srv.Close()
+	return nil
+}
+
+// waitFor waits for wg until ctx is done
+func waitFor(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
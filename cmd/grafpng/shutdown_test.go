@@ -0,0 +1,153 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"grafpng/grafana"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// drainReport generates until released or cancelled, counting the reports cleaned up
+type drainReport struct {
+	release chan struct{}
+	cleaned *atomic.Int32
+}
+
+func (r drainReport) Generate(ctx context.Context) (io.ReadCloser, error) {
+	select {
+	case <-r.release:
+		return io.NopCloser(strings.NewReader("png")), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (r drainReport) Clean() { r.cleaned.Add(1) }
+
+func (r drainReport) Title() string { return "title" }
+
+func TestGracefulShutdown(t *testing.T) {
+	Convey("When the service shuts down with a report in flight", t, func() {
+		defer func(q *jobQueue) { jobs = q }(jobs)
+		jobs = nil
+		defer draining.Store(false)
+
+		var cleaned atomic.Int32
+		rep := drainReport{make(chan struct{}), &cleaned}
+		started := make(chan struct{})
+		handler := http.NewServeMux()
+		handler.Handle("/readyz", NewReadyHandler(nil, time.Minute))
+		handler.HandleFunc("/api/v5/report/testDash", func(w http.ResponseWriter, req *http.Request) {
+			close(started)
+			serveReport(w, req, rep, grafana.NewTimeRange("", ""), 0, "")
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		stop, shutdown := context.WithCancel(context.Background())
+		srv := newServer(ctx, cancel, handler, 100*time.Millisecond, 200*time.Millisecond)
+		served := make(chan error, 1)
+		go func() { served <- srv.serve(stop, ln) }()
+
+		responses := make(chan *http.Response, 1)
+		go func() {
+			resp, err := http.Get("http://" + ln.Addr().String() + "/api/v5/report/testDash")
+			if err != nil {
+				resp = &http.Response{StatusCode: 0}
+			}
+			responses <- resp
+		}()
+		<-started
+		shutdown()
+
+		Convey("A report finishing within the timeout should be served", func() {
+			close(rep.release)
+			So((<-responses).StatusCode, ShouldEqual, http.StatusOK)
+			So(<-served, ShouldBeNil)
+			So(cleaned.Load(), ShouldEqual, 1)
+		})
+
+		Convey("A report still running at the timeout should be cancelled and cleaned up", func() {
+			start := time.Now()
+			So(<-served, ShouldBeNil)
+			So(time.Since(start), ShouldBeLessThan, time.Second)
+			So(cleaned.Load(), ShouldEqual, 1)
+			<-responses
+		})
+
+		Convey("The readiness check should fail, while still being served, before draining", func() {
+			time.Sleep(10 * time.Millisecond)
+			resp, err := http.Get("http://" + ln.Addr().String() + "/readyz")
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusServiceUnavailable)
+			close(rep.release)
+			<-served
+		})
+	})
+}
+
+func TestJobQueueShutdown(t *testing.T) {
+	Convey("When the job queue shuts down with a running and a queued job", t, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		q := newJobQueue(ctx, 1, 2, time.Hour)
+		var cleaned atomic.Int32
+		newJob := func(id string) *job {
+			rep := drainReport{make(chan struct{}), &cleaned}
+			return &job{id: id, ctx: ctx, report: preparedReport{rep: rep}, state: jobQueued}
+		}
+		running, queued := newJob("running"), newJob("queued")
+		So(q.submit(running), ShouldBeTrue)
+		So(q.submit(queued), ShouldBeTrue)
+		for running.status().State != jobRunning {
+			time.Sleep(time.Millisecond)
+		}
+
+		deadline, cancelDeadline := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancelDeadline()
+		err := q.shutdown(deadline)
+
+		Convey("It should wait for the running job until the deadline", func() {
+			So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+		})
+
+		Convey("It should reject new jobs", func() {
+			So(q.submit(newJob("late")), ShouldBeFalse)
+		})
+
+		Convey("Cancelling should fail and clean up all jobs", func() {
+			cancel()
+			So(waitFor(context.Background(), &q.active), ShouldBeNil)
+			So(running.status().State, ShouldEqual, jobFailed)
+			So(queued.status().State, ShouldEqual, jobFailed)
+			So(queued.status().Error, ShouldContainSubstring, "shut down")
+			So(cleaned.Load(), ShouldEqual, 2)
+		})
+	})
+}
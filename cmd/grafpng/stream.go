@@ -0,0 +1,82 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"grafpng/grafana"
+	"grafpng/report"
+)
+
+// streamable reports whether the report requested by req may be encoded straight to the response.
+// Streamed reports are sent before their ETag is known, so only reports generated in memory for clients that
+// opted out of keeping them, with Cache-Control: no-store, are streamed if they are not cached either.
+// Other in-memory reports are encoded to a buffer and sent with their ETag.
+func streamable(req *http.Request, cacheKey string) bool {
+	return report.InMemory() && cacheKey == "" && noStore(req)
+}
+
+// noStore reports whether the request tells that the client does not keep the response
+func noStore(req *http.Request) bool {
+	for _, v := range req.Header.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(d), "no-store") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// streamReport encodes rep straight to the response. The headers are written with the first bytes of the image,
+// so errors rendering the report are still answered with an error status.
+func streamReport(w http.ResponseWriter, req *http.Request, s report.Streamer, rep report.Report, dt grafana.TimeRange, org int) {
+	ctx := req.Context()
+	sw := &streamWriter{w: w, header: func() {
+		addFilenameHeader(req, w, reportFilename(rep, dt, org))
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", reportCacheControl)
+	}}
+	err := s.Stream(ctx, sw)
+	if err != nil && !sw.started {
+		httpError(w, req, "error generating report", err)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "error writing report to response", "error", err)
+		return
+	}
+	slog.InfoContext(ctx, "report generated correctly", "title", rep.Title())
+}
+
+// streamWriter calls header before the first write to w
+type streamWriter struct {
+	w       http.ResponseWriter
+	header  func()
+	started bool
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	if !sw.started {
+		sw.started = true
+		sw.header()
+	}
+	return sw.w.Write(p)
+}
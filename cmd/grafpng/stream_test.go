@@ -0,0 +1,109 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"grafpng/grafana"
+	"grafpng/report"
+
+	"github.com/gorilla/mux"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// streamingReport writes "png" to the stream, or fails with err before writing
+type streamingReport struct {
+	pngReport
+	streamed *int
+	err      error
+}
+
+func (r streamingReport) Stream(ctx context.Context, w io.Writer) error {
+	*r.streamed++
+	if r.err != nil {
+		return r.err
+	}
+	_, err := io.WriteString(w, "png")
+	return err
+}
+
+func TestStreamReport(t *testing.T) {
+	Convey("When reports are generated in memory", t, func() {
+		defer report.SetInMemory(false)
+		report.SetInMemory(true)
+		generated, streamed := 0, 0
+		var streamErr error
+		newReport := func(g grafana.Client, dashName string, _ grafana.TimeRange, worker int, opts report.Options) report.Report {
+			return streamingReport{pngReport{generated: &generated}, &streamed, streamErr}
+		}
+		router := mux.NewRouter()
+		RegisterHandlers(router, ServeReportHandler{nil, nil}, ServeReportHandler{grafana.NewV5Client, newReport}, ServeReportHandler{nil, nil})
+		get := func(cacheControl, ifNoneMatch string) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/api/v5/report/testDash?from=1500000000000&to=1500003600000", nil)
+			if cacheControl != "" {
+				req.Header.Set("Cache-Control", cacheControl)
+			}
+			if ifNoneMatch != "" {
+				req.Header.Set("If-None-Match", ifNoneMatch)
+			}
+			router.ServeHTTP(rec, req)
+			return rec
+		}
+
+		Convey("The report should be sent with its ETag", func() {
+			rec := get("", "")
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(rec.Body.String(), ShouldEqual, "png")
+			So(rec.Header().Get("ETag"), ShouldEqual, etag([]byte("png")))
+			So(streamed, ShouldEqual, 0)
+			So(generated, ShouldEqual, 1)
+		})
+
+		Convey("Clients holding the report should be answered not modified", func() {
+			rec := get("", etag([]byte("png")))
+			So(rec.Code, ShouldEqual, http.StatusNotModified)
+		})
+
+		Convey("When the client does not keep the report", func() {
+			Convey("The report should be streamed to the response", func() {
+				rec := get("max-age=0, No-Store", "")
+				So(rec.Code, ShouldEqual, http.StatusOK)
+				So(rec.Body.String(), ShouldEqual, "png")
+				So(rec.Header().Get("Content-Type"), ShouldEqual, "image/png")
+				So(rec.Header().Get("Content-Disposition"), ShouldContainSubstring, "title")
+				So(rec.Header().Get("ETag"), ShouldBeEmpty)
+				So(streamed, ShouldEqual, 1)
+				So(generated, ShouldEqual, 0)
+			})
+
+			Convey("Errors before the image is written should be answered with an error status", func() {
+				streamErr = errors.New("grafana is down")
+				rec := get("no-store", "")
+				So(rec.Code, ShouldEqual, http.StatusInternalServerError)
+				So(rec.Body.String(), ShouldContainSubstring, "grafana is down")
+				So(rec.Header().Get("Content-Disposition"), ShouldBeEmpty)
+			})
+		})
+	})
+}
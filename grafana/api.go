@@ -17,164 +17,299 @@
 package grafana
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
+
+	"grafpng/logging"
+	"grafpng/metrics"
 )
 
 // Client is a Grafana API client
 type Client interface {
-	GetDashboard(dashName string) (Dashboard, error)
-	GetPanelPng(p Panel, dashName string, t TimeRange) (io.ReadCloser, error)
+	GetDashboard(ctx context.Context, dashName string) (Dashboard, error)
+	GetPanelPng(ctx context.Context, p Panel, dashName string, t TimeRange) (io.ReadCloser, error)
+	SearchDashboards(ctx context.Context, q SearchQuery) ([]SearchResult, error)
+}
+
+// Config describes how to reach and authenticate against a Grafana instance
+type Config struct {
+	// URL is the Grafana base url, e.g. http://localhost:3000
+	URL string
+	// APIToken is sent as a bearer token. If empty, Username and Password are used for basic auth
+	// and if those are empty too, authorization headers will be omitted from requests.
+	APIToken string
+	Username string
+	Password string
+	// OrgID selects the Grafana organisation, 0 uses the organisation of the api token or user
+	OrgID int
+	// HTTPClient is used for all requests, e.g. to configure TLS. Defaults to a plain http.Client
+	HTTPClient *http.Client
+	// Render overrides how panels are rendered
+	Render RenderOptions
+	// Cache keeps rendered panels for identical render requests
+	Cache CacheOptions
+}
+
+// RenderOptions override the parameters panels are rendered with. Zero values keep the defaults:
+// 800 pixels wide, a height depending on the panel type, the light theme and the browser timezone of the renderer
+type RenderOptions struct {
+	Width  int
+	Height int
+	// Scale is the device scale factor, e.g. 2 for high dpi images. Needs a Grafana image renderer supporting it
+	Scale    float64
+	Theme    string
+	Timezone string
 }
 
 type client struct {
-	url              string
-	getDashEndpoint  func(dashName string) string
-	getPanelEndpoint func(dashName string, vals url.Values) string
-	apiToken         string
-	variables        url.Values
+	Config
+	getDashEndpoint     func(dashName string) string
+	getPanelEndpoint    func(dashName string, vals url.Values) string
+	searchDashName      func(r SearchResult) string
+	getVersionsEndpoint func(dashName string) string
+	variables           url.Values
+	// secretPaths names the url path segments followed by a secret, which is redacted from logged urls
+	secretPaths []string
 }
 
 var getPanelRetrySleepTime = time.Duration(10) * time.Second
 
-// NewV4Client creates a new Grafana 4 Client. If apiToken is the empty string,
-// authorization headers will be omitted from requests.
+// NewV4Client creates a new Grafana 4 Client for the Grafana instance described by cfg.
 // variables are Grafana template variable url values of the form var-{name}={value}, e.g. var-host=dev
-func NewV4Client(grafanaURL string, apiToken string, variables url.Values) Client {
+func NewV4Client(cfg Config, variables url.Values) Client {
 	getDashEndpoint := func(dashName string) string {
-		dashURL := grafanaURL + "/api/dashboards/db/" + dashName
-		if len(variables) > 0 {
-			dashURL = dashURL + "?" + variables.Encode()
-		}
-		return dashURL
+		return withQuery(cfg.URL+"/api/dashboards/db/"+dashName, cfg.OrgID, variables)
 	}
 
 	getPanelEndpoint := func(dashName string, vals url.Values) string {
-		return fmt.Sprintf("%s/render/dashboard-solo/db/%s?%s", grafanaURL, dashName, vals.Encode())
+		return fmt.Sprintf("%s/render/dashboard-solo/db/%s?%s", cfg.URL, dashName, vals.Encode())
 	}
-	return client{grafanaURL, getDashEndpoint, getPanelEndpoint, apiToken, variables}
+
+	searchDashName := func(r SearchResult) string {
+		return strings.TrimPrefix(r.URI, "db/")
+	}
+	return client{cfg, getDashEndpoint, getPanelEndpoint, searchDashName, nil, variables, nil}
 }
 
-// NewV5Client creates a new Grafana 5 Client. If apiToken is the empty string,
-// authorization headers will be omitted from requests.
+// NewV5Client creates a new Grafana 5 Client for the Grafana instance described by cfg.
 // variables are Grafana template variable url values of the form var-{name}={value}, e.g. var-host=dev
-func NewV5Client(grafanaURL string, apiToken string, variables url.Values) Client {
+func NewV5Client(cfg Config, variables url.Values) Client {
 	getDashEndpoint := func(dashName string) string {
-		dashURL := grafanaURL + "/api/dashboards/uid/" + dashName
-		if len(variables) > 0 {
-			dashURL = dashURL + "?" + variables.Encode()
-		}
-		return dashURL
+		return withQuery(cfg.URL+"/api/dashboards/uid/"+dashName, cfg.OrgID, variables)
 	}
 
 	getPanelEndpoint := func(dashName string, vals url.Values) string {
-		return fmt.Sprintf("%s/render/d-solo/%s/_?%s", grafanaURL, dashName, vals.Encode())
+		return fmt.Sprintf("%s/render/d-solo/%s/_?%s", cfg.URL, dashName, vals.Encode())
+	}
+
+	searchDashName := func(r SearchResult) string {
+		return r.UID
+	}
+
+	getVersionsEndpoint := func(dashName string) string {
+		return cfg.URL + "/api/dashboards/uid/" + dashName + "/versions"
+	}
+	return client{cfg, getDashEndpoint, getPanelEndpoint, searchDashName, getVersionsEndpoint, variables, nil}
+}
+
+// withQuery appends the organisation and template variables to an api endpoint
+func withQuery(endpoint string, orgID int, variables url.Values) string {
+	query := url.Values{}
+	if orgID > 0 {
+		query.Set("orgId", strconv.Itoa(orgID))
+	}
+	for k, v := range variables {
+		query[k] = v
+	}
+	if len(query) > 0 {
+		endpoint = endpoint + "?" + query.Encode()
+	}
+	return endpoint
+}
+
+func (g client) GetDashboard(ctx context.Context, dashName string) (Dashboard, error) {
+	body, err := g.getAPI(ctx, "getDashboard", g.getDashEndpoint(dashName))
+	if err != nil {
+		return Dashboard{}, err
+	}
+
+	dash, err := ParseDashboard(body, g.variables)
+	if err != nil {
+		return Dashboard{}, err
 	}
-	return client{grafanaURL, getDashEndpoint, getPanelEndpoint, apiToken, variables}
+	slog.DebugContext(ctx, "populated dashboard", "title", dash.Title, "panels", len(dash.Panels))
+	return dash, nil
 }
 
-func (g client) GetDashboard(dashName string) (Dashboard, error) {
-	dashURL := g.getDashEndpoint(dashName)
-	log.Println("Connecting to dashboard at", dashURL)
+// getAPI fetches the body of a Grafana api endpoint. op names the operation in log records and errors.
+func (g client) getAPI(ctx context.Context, op string, apiURL string) ([]byte, error) {
+	logURL := logging.RedactPathAfter(apiURL, g.secretPaths...)
+	slog.InfoContext(ctx, "calling grafana api", "op", op, "url", logURL)
 
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", dashURL, nil)
+	client := g.httpClient()
+	req, err := http.NewRequestWithContext(ctx, "GET", apiURL, nil)
 	if err != nil {
-		return Dashboard{}, fmt.Errorf("error creating getDashboard request for %v: %v", dashURL, err)
+		return nil, fmt.Errorf("error creating %v request for %v: %v", op, logURL, err)
 	}
 
-	if g.apiToken != "" {
-		req.Header.Add("Authorization", "Bearer "+g.apiToken)
+	g.authorize(req)
+	if g.OrgID > 0 {
+		req.Header.Add("X-Grafana-Org-Id", strconv.Itoa(g.OrgID))
 	}
 	resp, err := client.Do(req)
+	metrics.ObserveGrafana(op, resp, err)
 	if err != nil {
-		return Dashboard{}, fmt.Errorf("error executing getDashboard request for %v: %v", dashURL, err)
+		return nil, fmt.Errorf("error executing %v request for %v: %v", op, logURL, err)
 	}
 	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return Dashboard{}, fmt.Errorf("error reading getDashboard response body from %v: %v", dashURL, err)
+		return nil, fmt.Errorf("error reading %v response body from %v: %v", op, logURL, err)
 	}
 
 	if resp.StatusCode != 200 {
-		return Dashboard{}, fmt.Errorf("error obtaining dashboard from %v. Got Status %v, message: %v ", dashURL, resp.Status, string(body))
+		return nil, fmt.Errorf("error obtaining %v from %v. Got Status %v, message: %v ", op, logURL, resp.Status, string(body))
 	}
+	return body, nil
+}
 
-	return NewDashboard(body, g.variables), nil
+func (g client) GetPanelPng(ctx context.Context, p Panel, dashName string, t TimeRange) (io.ReadCloser, error) {
+	fetch := func() (io.ReadCloser, error) {
+		return g.fetchPanelPng(ctx, p, dashName, t)
+	}
+	if g.Cache.Store == nil {
+		return fetch()
+	}
+	return g.cachedPanelPng(ctx, p, dashName, t, fetch)
 }
 
-func (g client) GetPanelPng(p Panel, dashName string, t TimeRange) (io.ReadCloser, error) {
+// fetchPanelPng renders p with the Grafana render api
+func (g client) fetchPanelPng(ctx context.Context, p Panel, dashName string, t TimeRange) (io.ReadCloser, error) {
 	panelURL := g.getPanelURL(p, dashName, t)
+	logURL := logging.RedactPathAfter(panelURL, g.secretPaths...)
+	slog.DebugContext(ctx, "downloading panel image", "panel", p.ID, "url", logURL)
 
-	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+	client := g.httpClient()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
 		return errors.New("Error getting panel png. Redirected to login")
-	}}
-	req, err := http.NewRequest("GET", panelURL, nil)
-	if err != nil {
-		return nil, fmt.Errorf("error creating getPanelPng request for %v: %v", panelURL, err)
 	}
-	if g.apiToken != "" {
-		req.Header.Add("Authorization", "Bearer "+g.apiToken)
+	req, err := http.NewRequestWithContext(ctx, "GET", panelURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating getPanelPng request for %v: %v", logURL, err)
 	}
+	g.authorize(req)
 	resp, err := client.Do(req)
+	metrics.ObserveGrafana("getPanelPng", resp, err)
 	if err != nil {
-		return nil, fmt.Errorf("error executing getPanelPng request for %v: %v", panelURL, err)
+		return nil, fmt.Errorf("error executing getPanelPng request for %v: %v", logURL, err)
 	}
 
 	for retries := 1; retries < 3 && resp.StatusCode != 200; retries++ {
 		delay := getPanelRetrySleepTime * time.Duration(retries)
-		log.Printf("Error obtaining render for panel %+v, Status: %v, Retrying after %v...", p, resp.StatusCode, delay)
-		time.Sleep(delay)
+		slog.WarnContext(ctx, "error obtaining panel render, retrying", "panel", p.ID, "status", resp.StatusCode, "delay", delay)
+		resp.Body.Close()
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		metrics.GrafanaRetries.Inc()
 		resp, err = client.Do(req)
+		metrics.ObserveGrafana("getPanelPng", resp, err)
 		if err != nil {
-			return nil, fmt.Errorf("error executing retry getPanelPng request for %v: %v", panelURL, err)
+			return nil, fmt.Errorf("error executing retry getPanelPng request for %v: %v", logURL, err)
 		}
 	}
 
 	if resp.StatusCode != 200 {
 		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
 		if err != nil {
-			panic(err)
+			return nil, fmt.Errorf("error reading getPanelPng response body from %v: %v", logURL, err)
 		}
-		log.Println("Error obtaining render:", string(body))
+		slog.ErrorContext(ctx, "error obtaining panel render", "panel", p.ID, "status", resp.StatusCode, "body", string(body))
 		return nil, errors.New("Error obtaining render: " + resp.Status)
 	}
 
 	return resp.Body, nil
 }
 
+// httpClient returns a copy of the configured http client which can be customised per request
+func (g client) httpClient() *http.Client {
+	if g.HTTPClient == nil {
+		return &http.Client{}
+	}
+	c := *g.HTTPClient
+	return &c
+}
+
+// authorize adds the configured credentials to req
+func (g client) authorize(req *http.Request) {
+	if g.APIToken != "" {
+		req.Header.Add("Authorization", "Bearer "+g.APIToken)
+	} else if g.Username != "" {
+		req.SetBasicAuth(g.Username, g.Password)
+	}
+}
+
 func (g client) getPanelURL(p Panel, dashName string, t TimeRange) string {
 	values := url.Values{}
-	values.Add("theme", "light")
+	theme := "light"
+	if g.Render.Theme != "" {
+		theme = g.Render.Theme
+	}
+	values.Add("theme", theme)
 	values.Add("panelId", strconv.Itoa(p.ID))
+	if g.OrgID > 0 {
+		values.Add("orgId", strconv.Itoa(g.OrgID))
+	}
 	values.Add("from", t.From)
 	values.Add("to", t.To)
-	if p.Is(SingleStat) {
-		values.Add("width", "800")
-		values.Add("height", "200")
-	} else if p.Is(Text) {
-		values.Add("width", "800")
-		values.Add("height", "200")
-	} else {
-		values.Add("width", "800")
-		values.Add("height", "400")
+	width := strconv.Itoa(panelWidth)
+	if p.RenderWidth > 0 {
+		width = strconv.Itoa(p.RenderWidth)
+	} else if g.Render.Width > 0 {
+		width = strconv.Itoa(g.Render.Width)
+	}
+	height := "400"
+	if p.Is(SingleStat) || p.Is(Text) {
+		height = "200"
+	}
+	if g.Render.Height > 0 {
+		height = strconv.Itoa(g.Render.Height)
+	}
+	values.Add("width", width)
+	values.Add("height", height)
+	if g.Render.Scale > 0 {
+		values.Add("scale", strconv.FormatFloat(g.Render.Scale, 'f', -1, 64))
+	}
+	if g.Render.Timezone != "" {
+		values.Add("tz", g.Render.Timezone)
 	}
 
 	for k, v := range g.variables {
+		if _, scoped := p.ScopedVars[k]; scoped {
+			continue
+		}
+		for _, singleValue := range v {
+			values.Add(k, singleValue)
+		}
+	}
+	for k, v := range p.ScopedVars {
 		for _, singleValue := range v {
 			values.Add(k, singleValue)
 		}
 	}
 
-	url := g.getPanelEndpoint(dashName, values)
-	log.Println("Downloading image ", p.ID, url)
-	return url
+	return g.getPanelEndpoint(dashName, values)
 }
@@ -17,6 +17,8 @@
 package grafana
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -37,8 +39,8 @@ func TestGrafanaClientFetchesDashboard(t *testing.T) {
 		defer ts.Close()
 
 		Convey("When using the Grafana v4 client", func() {
-			grf := NewV4Client(ts.URL, "", url.Values{})
-			grf.GetDashboard("testDash")
+			grf := NewV4Client(Config{URL: ts.URL}, url.Values{})
+			grf.GetDashboard(context.Background(), "testDash")
 
 			Convey("It should use the v4 dashboards endpoint", func() {
 				So(requestURI, ShouldEqual, "/api/dashboards/db/testDash")
@@ -46,14 +48,23 @@ func TestGrafanaClientFetchesDashboard(t *testing.T) {
 		})
 
 		Convey("When using the Grafana v5 client", func() {
-			grf := NewV5Client(ts.URL, "", url.Values{})
-			grf.GetDashboard("rYy7Paekz")
+			grf := NewV5Client(Config{URL: ts.URL}, url.Values{})
+			grf.GetDashboard(context.Background(), "rYy7Paekz")
 
 			Convey("It should use the v5 dashboards endpoint", func() {
 				So(requestURI, ShouldEqual, "/api/dashboards/uid/rYy7Paekz")
 			})
 		})
 
+		Convey("When using a client for a specific organisation", func() {
+			grf := NewV5Client(Config{URL: ts.URL, OrgID: 3}, url.Values{})
+			grf.GetDashboard(context.Background(), "rYy7Paekz")
+
+			Convey("It should request the dashboard from that organisation", func() {
+				So(requestURI, ShouldEqual, "/api/dashboards/uid/rYy7Paekz?orgId=3")
+			})
+		})
+
 	})
 }
 
@@ -77,12 +88,12 @@ func TestGrafanaClientFetchesPanelPNG(t *testing.T) {
 			client      Client
 			pngEndpoint string
 		}{
-			"v4": {NewV4Client(ts.URL, apiToken, variables), "/render/dashboard-solo/db/testDash"},
-			"v5": {NewV5Client(ts.URL, apiToken, variables), "/render/d-solo/testDash/_"},
+			"v4": {NewV4Client(Config{URL: ts.URL, APIToken: apiToken}, variables), "/render/dashboard-solo/db/testDash"},
+			"v5": {NewV5Client(Config{URL: ts.URL, APIToken: apiToken}, variables), "/render/d-solo/testDash/_"},
 		}
 		for clientDesc, cl := range cases {
 			grf := cl.client
-			grf.GetPanelPng(Panel{44, "singlestat", "title"}, "testDash", TimeRange{"now-1h", "now"})
+			grf.GetPanelPng(context.Background(), Panel{ID: 44, Type: "singlestat", Title: "title"}, "testDash", TimeRange{"now-1h", "now"})
 
 			Convey(fmt.Sprintf("The %s client should use the render endpoint with the dashboard name", clientDesc), func() {
 				So(requestURI, ShouldStartWith, cl.pngEndpoint)
@@ -106,26 +117,78 @@ func TestGrafanaClientFetchesPanelPNG(t *testing.T) {
 				So(requestURI, ShouldContainSubstring, "var-port=adapter")
 			})
 
+			Convey(fmt.Sprintf("The %s client should let panel scoped variables override the client variables", clientDesc), func() {
+				grf.GetPanelPng(context.Background(), Panel{ID: 44, Type: "graph", ScopedVars: url.Values{"var-host": {"web1"}}}, "testDash", TimeRange{"now-1h", "now"})
+				So(requestURI, ShouldContainSubstring, "var-host=web1")
+				So(requestURI, ShouldNotContainSubstring, "var-host=servername")
+				So(requestURI, ShouldContainSubstring, "var-port=adapter")
+			})
+
+			Convey(fmt.Sprintf("The %s client should not request an organisation unless configured", clientDesc), func() {
+				So(requestURI, ShouldNotContainSubstring, "orgId")
+			})
+
 			Convey(fmt.Sprintf("The %s client should request singlestat panels at a smaller size", clientDesc), func() {
 				So(requestURI, ShouldContainSubstring, "width=800")
 				So(requestURI, ShouldContainSubstring, "height=200")
 			})
 
 			Convey(fmt.Sprintf("The %s client should request text panels with a small height", clientDesc), func() {
-				grf.GetPanelPng(Panel{44, "text", "title"}, "testDash", TimeRange{"now", "now-1h"})
+				grf.GetPanelPng(context.Background(), Panel{ID: 44, Type: "text", Title: "title"}, "testDash", TimeRange{"now", "now-1h"})
 				So(requestURI, ShouldContainSubstring, "width=800")
 				So(requestURI, ShouldContainSubstring, "height=200")
 			})
 
 			Convey(fmt.Sprintf("The %s client should request other panels in a larger size", clientDesc), func() {
-				grf.GetPanelPng(Panel{44, "graph", "title"}, "testDash", TimeRange{"now", "now-1h"})
+				grf.GetPanelPng(context.Background(), Panel{ID: 44, Type: "graph", Title: "title"}, "testDash", TimeRange{"now", "now-1h"})
 				So(requestURI, ShouldContainSubstring, "width=800")
 				So(requestURI, ShouldContainSubstring, "height=400")
 			})
+
+			Convey(fmt.Sprintf("The %s client should request repeated panels at their share of the width", clientDesc), func() {
+				grf.GetPanelPng(context.Background(), Panel{ID: 44, Type: "graph", RenderWidth: 400}, "testDash", TimeRange{"now", "now-1h"})
+				So(requestURI, ShouldContainSubstring, "width=400")
+				So(requestURI, ShouldNotContainSubstring, "width=800")
+			})
 		}
 	})
 }
 
+func TestGrafanaClientFetchesPanelPNGFromOrganisation(t *testing.T) {
+	Convey("When fetching a panel PNG with an organisation configured", t, func() {
+		requestURI := ""
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestURI = r.RequestURI
+		}))
+		defer ts.Close()
+
+		grf := NewV5Client(Config{URL: ts.URL, OrgID: 2}, url.Values{})
+		grf.GetPanelPng(context.Background(), Panel{ID: 44, Type: "graph", Title: "title"}, "testDash", TimeRange{"now-1h", "now"})
+
+		Convey("The render request should select the organisation", func() {
+			So(requestURI, ShouldContainSubstring, "orgId=2")
+		})
+	})
+}
+
+func TestGrafanaClientBasicAuth(t *testing.T) {
+	Convey("When the client is configured with a username and password", t, func() {
+		var user, pass string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, pass, _ = r.BasicAuth()
+		}))
+		defer ts.Close()
+
+		grf := NewV5Client(Config{URL: ts.URL, Username: "admin", Password: "pw"}, url.Values{})
+		grf.GetPanelPng(context.Background(), Panel{ID: 44, Type: "graph", Title: "title"}, "testDash", TimeRange{"now-1h", "now"})
+
+		Convey("Requests should use basic auth", func() {
+			So(user, ShouldEqual, "admin")
+			So(pass, ShouldEqual, "pw")
+		})
+	})
+}
+
 func init() {
 	getPanelRetrySleepTime = time.Duration(1) * time.Millisecond //we want our tests to run fast
 }
@@ -143,9 +206,9 @@ func TestGrafanaClientFetchPanelPNGErrorHandling(t *testing.T) {
 		}))
 		defer ts.Close()
 
-		grf := NewV4Client(ts.URL, "", url.Values{})
+		grf := NewV4Client(Config{URL: ts.URL}, url.Values{})
 
-		_, err := grf.GetPanelPng(Panel{44, "singlestat", "title"}, "testDash", TimeRange{"now-1h", "now"})
+		_, err := grf.GetPanelPng(context.Background(), Panel{ID: 44, Type: "singlestat", Title: "title"}, "testDash", TimeRange{"now-1h", "now"})
 
 		Convey("It should retry a couple of times if it receives errors", func() {
 			So(err, ShouldBeNil)
@@ -158,12 +221,31 @@ func TestGrafanaClientFetchPanelPNGErrorHandling(t *testing.T) {
 		}))
 		defer ts.Close()
 
-		grf := NewV4Client(ts.URL, "", url.Values{})
+		grf := NewV4Client(Config{URL: ts.URL}, url.Values{})
 
-		_, err := grf.GetPanelPng(Panel{44, "singlestat", "title"}, "testDash", TimeRange{"now-1h", "now"})
+		_, err := grf.GetPanelPng(context.Background(), Panel{ID: 44, Type: "singlestat", Title: "title"}, "testDash", TimeRange{"now-1h", "now"})
 
 		Convey("The Grafana API should return an error", func() {
 			So(err, ShouldNotBeNil)
 		})
 	})
+
+	Convey("When the request is cancelled while waiting to retry", t, func() {
+		defer func(d time.Duration) { getPanelRetrySleepTime = d }(getPanelRetrySleepTime)
+		getPanelRetrySleepTime = time.Hour
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer ts.Close()
+
+		grf := NewV4Client(Config{URL: ts.URL}, url.Values{})
+
+		_, err := grf.GetPanelPng(ctx, Panel{ID: 44, Type: "singlestat", Title: "title"}, "testDash", TimeRange{"now-1h", "now"})
+
+		Convey("It should stop waiting and return the cancellation", func() {
+			So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+		})
+	})
 }
@@ -0,0 +1,93 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package grafana
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"grafpng/cache"
+	"grafpng/metrics"
+)
+
+// CacheOptions configure the caching of rendered panels
+type CacheOptions struct {
+	// Store keeps the rendered panels, nil renders every panel afresh
+	Store cache.Cache
+	// Granularity rounds the current time down when caching renders of relative time ranges,
+	// e.g. now-1h renders within the same minute share a cached image with a granularity of 1m.
+	// Renders of relative time ranges are not cached with a granularity of 0.
+	Granularity time.Duration
+	// Refresh renders panels afresh instead of using cached renders, caching the new renders
+	Refresh bool
+}
+
+// Rounded resolves the relative times of tr against the current time rounded down to granularity,
+// returning false if they can not be resolved, or tr is relative and granularity is 0.
+// Absolute time ranges are returned unchanged.
+func (tr TimeRange) Rounded(granularity time.Duration) (rounded TimeRange, ok bool) {
+	if !strings.Contains(tr.From, "now") && !strings.Contains(tr.To, "now") {
+		return tr, true
+	}
+	if granularity <= 0 {
+		return tr, false
+	}
+	defer func() {
+		//the time parser panics on unrecognised time specifications
+		if recover() != nil {
+			rounded, ok = tr, false
+		}
+	}()
+	n := now(time.Now().Truncate(granularity))
+	from := n.parseFrom(tr.From).UnixMilli()
+	to := n.parseTo(tr.To).UnixMilli()
+	return TimeRange{strconv.FormatInt(from, 10), strconv.FormatInt(to, 10)}, true
+}
+
+// cachedPanelPng returns the render of p from the cache, or else renders it with fetch and caches it
+func (g client) cachedPanelPng(ctx context.Context, p Panel, dashName string, t TimeRange, fetch func() (io.ReadCloser, error)) (io.ReadCloser, error) {
+	rounded, ok := t.Rounded(g.Cache.Granularity)
+	if !ok {
+		return fetch()
+	}
+	key := cache.Key("panel", g.APIToken, g.Username, g.Password, g.getPanelURL(p, dashName, rounded))
+	if g.Cache.Refresh {
+		metrics.CacheLookups.WithLabelValues("panel", "bypass").Inc()
+	} else if png, ok := g.Cache.Store.Get(key); ok {
+		metrics.CacheLookups.WithLabelValues("panel", "hit").Inc()
+		slog.DebugContext(ctx, "using cached panel image", "panel", p.ID)
+		return io.NopCloser(bytes.NewReader(png)), nil
+	} else {
+		metrics.CacheLookups.WithLabelValues("panel", "miss").Inc()
+	}
+	body, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	png, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	g.Cache.Store.Set(key, png)
+	return io.NopCloser(bytes.NewReader(png)), nil
+}
@@ -0,0 +1,116 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package grafana
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"grafpng/cache"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRoundedTimeRange(t *testing.T) {
+	Convey("When rounding time ranges for caching", t, func() {
+		Convey("Absolute time ranges should be kept", func() {
+			tr, ok := TimeRange{"1500000000000", "1500003600000"}.Rounded(0)
+			So(ok, ShouldBeTrue)
+			So(tr, ShouldResemble, TimeRange{"1500000000000", "1500003600000"})
+		})
+
+		Convey("Relative time ranges should not be cacheable without a granularity", func() {
+			_, ok := TimeRange{"now-1h", "now"}.Rounded(0)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Relative time ranges should be resolved against the rounded current time", func() {
+			tr, ok := TimeRange{"now-1h", "now"}.Rounded(time.Minute)
+			So(ok, ShouldBeTrue)
+			to, _ := strconv.ParseInt(tr.To, 10, 64)
+			from, _ := strconv.ParseInt(tr.From, 10, 64)
+			So(to%time.Minute.Milliseconds(), ShouldEqual, 0)
+			So(to-from, ShouldEqual, time.Hour.Milliseconds())
+		})
+
+		Convey("Unrecognised times should not be cacheable", func() {
+			_, ok := TimeRange{"now-1x", "now"}.Rounded(time.Minute)
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
+
+func TestCachedPanelPng(t *testing.T) {
+	Convey("When panels are rendered with a cache", t, func() {
+		renders := 0
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			renders++
+			fmt.Fprintf(w, "png%d", renders)
+		}))
+		defer ts.Close()
+
+		cfg := Config{URL: ts.URL, APIToken: "1234", Cache: CacheOptions{Store: cache.NewMemory(1<<20, 0), Granularity: time.Minute}}
+		render := func(cfg Config, p Panel, t TimeRange) string {
+			body, err := NewV5Client(cfg, url.Values{}).GetPanelPng(context.Background(), p, "testDash", t)
+			So(err, ShouldBeNil)
+			defer body.Close()
+			png, _ := io.ReadAll(body)
+			return string(png)
+		}
+		graph := Panel{ID: 44, Type: "graph"}
+		lastHour := TimeRange{"1500000000000", "1500003600000"}
+
+		Convey("Identical renders should be served from the cache", func() {
+			So(render(cfg, graph, lastHour), ShouldEqual, "png1")
+			So(render(cfg, graph, lastHour), ShouldEqual, "png1")
+			So(renders, ShouldEqual, 1)
+		})
+
+		Convey("Renders differing in panel, variables, size or credentials should not share cached images", func() {
+			render(cfg, graph, lastHour)
+			render(cfg, Panel{ID: 45, Type: "graph"}, lastHour)
+			render(cfg, Panel{ID: 44, Type: "graph", ScopedVars: url.Values{"var-host": {"web1"}}}, lastHour)
+			render(cfg, Panel{ID: 44, Type: "graph", RenderWidth: 400}, lastHour)
+			other := cfg
+			other.APIToken = "5678"
+			render(other, graph, lastHour)
+			So(renders, ShouldEqual, 5)
+		})
+
+		Convey("A refresh should render afresh and cache the new image", func() {
+			render(cfg, graph, lastHour)
+			refresh := cfg
+			refresh.Cache.Refresh = true
+			So(render(refresh, graph, lastHour), ShouldEqual, "png2")
+			So(render(cfg, graph, lastHour), ShouldEqual, "png2")
+		})
+
+		Convey("Relative time ranges should be rendered afresh without a granularity", func() {
+			cfg.Cache.Granularity = 0
+			render(cfg, graph, TimeRange{"now-1h", "now"})
+			render(cfg, graph, TimeRange{"now-1h", "now"})
+			So(renders, ShouldEqual, 2)
+		})
+	})
+}
@@ -18,7 +18,7 @@ package grafana
 
 import (
 	"encoding/json"
-	"log"
+	"fmt"
 	"net/url"
 	"strings"
 )
@@ -46,6 +46,20 @@ type Panel struct {
 	ID    int
 	Type  string
 	Title string
+	// Repeat names the template variable the panel is repeated for, one instance per value.
+	// RepeatDirection is h to lay the instances out side by side, at most MaxPerRow per row, or v to stack them
+	Repeat          string
+	RepeatDirection string
+	MaxPerRow       int
+	// ScopedVars override the dashboard's template variable values when rendering this panel,
+	// e.g. var-host=web1. Not read from the Grafana JSON structure
+	ScopedVars url.Values `json:"-"`
+	// RepeatIndex is the position of a repeated panel instance among the instances of its panel,
+	// RenderWidth overrides the width the panel is rendered with. Not read from the Grafana JSON structure
+	RepeatIndex int `json:"-"`
+	RenderWidth int `json:"-"`
+	// Panels holds the panels of a collapsed row panel, which Grafana 5+ nests inside the row panel
+	Panels []Panel
 }
 
 // Row represents a container for Panels
@@ -54,69 +68,125 @@ type Row struct {
 	Showtitle bool
 	Title     string
 	Panels    []Panel
+	// Repeat names the template variable the row is repeated for, one instance per value
+	Repeat string
+	// ScopedVars holds the value a repeated row instance is rendered with, e.g. var-host=web1.
+	// RepeatIndex is the position of the instance among the instances of its row.
+	// Not read from the Grafana JSON structure
+	ScopedVars  url.Values `json:"-"`
+	RepeatIndex int        `json:"-"`
 }
 
 // Dashboard represents a Grafana dashboard
 type Dashboard struct {
+	UID            string
 	Title          string
 	Description    string
 	VariableValues string //Not present in the Grafana JSON structure
 	Rows           []Row
 	Panels         []Panel
+	Variables      []Variable `json:"-"` //Parsed from the templating list, merged with the requested values
+	// Version describes the revision of the dashboard if it was fetched from the dashboard versions api
+	Version *DashboardVersion `json:"-"`
 }
 
 type dashContainer struct {
-	Dashboard Dashboard
-	Meta      struct {
+	Dashboard struct {
+		Dashboard
+		Templating struct {
+			List []Variable
+		}
+	}
+	Meta struct {
 		Slug string
 	}
 }
 
 // NewDashboard creates Dashboard from Grafana's internal JSON dashboard definition
 func NewDashboard(dashJSON []byte, variables url.Values) Dashboard {
-	var dash dashContainer
-	err := json.Unmarshal(dashJSON, &dash)
+	dash, err := ParseDashboard(dashJSON, variables)
 	if err != nil {
 		panic(err)
 	}
-	d := dash.NewDashboard(variables)
-	log.Printf("Populated dashboard datastructure: %+v\n", d)
-	return d
+	return dash
+}
+
+// ParseDashboard creates Dashboard from a JSON dashboard definition, either as returned by the
+// Grafana dashboard api or as exported from Grafana, and returns an error if it is not valid JSON
+func ParseDashboard(dashJSON []byte, variables url.Values) (Dashboard, error) {
+	var dc dashContainer
+	err := json.Unmarshal(dashJSON, &dc)
+	if err != nil {
+		return Dashboard{}, fmt.Errorf("error parsing dashboard json: %v", err)
+	}
+	if dc.isEmpty() {
+		//exported dashboards are not wrapped in a dashboard field
+		err = json.Unmarshal(dashJSON, &dc.Dashboard)
+		if err != nil {
+			return Dashboard{}, fmt.Errorf("error parsing exported dashboard json: %v", err)
+		}
+	}
+	return dc.NewDashboard(variables), nil
+}
+
+func (dc dashContainer) isEmpty() bool {
+	d := dc.Dashboard
+	return d.Title == "" && len(d.Panels) == 0 && len(d.Rows) == 0
 }
 
 func (dc dashContainer) NewDashboard(variables url.Values) Dashboard {
 	var dash Dashboard
+	dash.UID = dc.Dashboard.UID
 	dash.Title = dc.Dashboard.Title
 	dash.Description = dc.Dashboard.Description
 	dash.VariableValues = getVariablesValues(variables)
+	dash.Variables = mergeVariables(dc.Dashboard.Templating.List, variables)
 
 	if len(dc.Dashboard.Rows) == 0 {
-		return populatePanelsFromV5JSON(dash, dc)
+		dash = populatePanelsFromV5JSON(dash, dc)
+	} else {
+		dash = populatePanelsFromV4JSON(dash, dc)
+	}
+	for i, row := range dash.Rows {
+		dash.Rows[i].Panels = dash.repeatPanels(row.Panels)
 	}
-	return populatePanelsFromV4JSON(dash, dc)
+	dash.Panels = dash.rowPanels()
+	return dash
 }
 
 func populatePanelsFromV4JSON(dash Dashboard, dc dashContainer) Dashboard {
-	for _, row := range dc.Dashboard.Rows {
-		for i, p := range row.Panels {
-			row.Panels[i] = p
-			dash.Panels = append(dash.Panels, p)
-		}
-		dash.Rows = append(dash.Rows, row)
-	}
+	dash.Rows = append(dash.Rows, dc.Dashboard.Rows...)
 	return dash
 }
 
+// populatePanelsFromV5JSON groups the panels following each row panel into a Row.
+// Panels above the first row panel are grouped into a Row without title.
+// A collapsed row panel holds its panels itself rather than being followed by them.
 func populatePanelsFromV5JSON(dash Dashboard, dc dashContainer) Dashboard {
 	for _, p := range dc.Dashboard.Panels {
 		if p.Type == "row" {
+			dash.Rows = append(dash.Rows, Row{ID: p.ID, Showtitle: true, Title: p.Title, Repeat: p.Repeat, Panels: p.Panels})
 			continue
 		}
-		dash.Panels = append(dash.Panels, p)
+		if len(dash.Rows) == 0 {
+			dash.Rows = append(dash.Rows, Row{})
+		}
+		last := &dash.Rows[len(dash.Rows)-1]
+		last.Panels = append(last.Panels, p)
 	}
+	dash.Rows = dash.repeatRows(dash.Rows)
 	return dash
 }
 
+// rowPanels returns the panels of all rows, in order
+func (d Dashboard) rowPanels() []Panel {
+	var panels []Panel
+	for _, row := range d.Rows {
+		panels = append(panels, row.Panels...)
+	}
+	return panels
+}
+
 func (p Panel) IsSingleStat() bool {
 	return p.Is(SingleStat)
 }
@@ -139,6 +209,32 @@ func (r Row) IsVisible() bool {
 	return r.Showtitle
 }
 
+// IsRepeated reports whether r is an instance of a row repeated for a template variable
+func (r Row) IsRepeated() bool {
+	return r.ScopedVars != nil
+}
+
+// HasRepeatedRows reports whether any of the dashboard's rows is a repeated row instance
+func (d Dashboard) HasRepeatedRows() bool {
+	for _, r := range d.Rows {
+		if r.IsRepeated() {
+			return true
+		}
+	}
+	return false
+}
+
+// VisibleVariables returns the template variables Grafana shows on the dashboard
+func (d Dashboard) VisibleVariables() []Variable {
+	var visible []Variable
+	for _, v := range d.Variables {
+		if v.Hide != HideVariable && v.Type != "adhoc" && len(v.Values) > 0 {
+			visible = append(visible, v)
+		}
+	}
+	return visible
+}
+
 func getVariablesValues(variables url.Values) string {
 	values := []string{}
 	for _, v := range variables {
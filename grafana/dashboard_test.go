@@ -140,3 +140,22 @@ func TestVariableValues(t *testing.T) {
 		})
 	})
 }
+
+func TestParseDashboard(t *testing.T) {
+	Convey("When parsing a dashboard definition", t, func() {
+		Convey("Exported dashboards should be parsed like api responses", func() {
+			exported, err := ParseDashboard([]byte(`{"uid": "abc", "title": "Exported", "panels": [{"type": "graph", "id": 1}]}`), url.Values{})
+			So(err, ShouldBeNil)
+			api, err := ParseDashboard([]byte(`{"dashboard": {"uid": "abc", "title": "Exported", "panels": [{"type": "graph", "id": 1}]}}`), url.Values{})
+			So(err, ShouldBeNil)
+			So(exported, ShouldResemble, api)
+			So(exported.UID, ShouldEqual, "abc")
+			So(exported.Panels, ShouldHaveLength, 1)
+		})
+
+		Convey("Invalid json should return an error", func() {
+			_, err := ParseDashboard([]byte(`{"title": `), url.Values{})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
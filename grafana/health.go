@@ -0,0 +1,75 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package grafana
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"grafpng/metrics"
+)
+
+// CheckHealth verifies that the Grafana instance described by cfg can serve reports: /api/health must report
+// a working database, and an authenticated search must succeed with the configured credentials.
+// Grafana 4 and older, which have no health endpoint, are checked with the search alone.
+// Instances without configured credentials, which are passed with each request instead, skip the search.
+func CheckHealth(ctx context.Context, cfg Config) error {
+	g := client{Config: cfg}
+	err := g.checkDatabase(ctx)
+	if err != nil {
+		return err
+	}
+	if cfg.APIToken == "" && cfg.Username == "" {
+		return nil
+	}
+	_, err = g.getAPI(ctx, "checkCredentials", withQuery(cfg.URL+"/api/search", cfg.OrgID, url.Values{"limit": {"1"}}))
+	if err != nil {
+		return fmt.Errorf("error checking grafana credentials: %v", err)
+	}
+	return nil
+}
+
+// checkDatabase queries /api/health, which Grafana answers with 503 Service Unavailable if its database fails
+func (g client) checkDatabase(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", g.URL+"/api/health", nil)
+	if err != nil {
+		return fmt.Errorf("error creating grafana health request: %v", err)
+	}
+	resp, err := g.httpClient().Do(req)
+	metrics.ObserveGrafana("checkHealth", resp, err)
+	if err != nil {
+		return fmt.Errorf("error reaching grafana: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading grafana health: %v", err)
+	}
+	var health struct{ Database string }
+	json.Unmarshal(body, &health)
+	if resp.StatusCode != http.StatusOK || health.Database != "ok" {
+		return fmt.Errorf("grafana is unhealthy. Got Status %v, database: %q", resp.Status, health.Database)
+	}
+	return nil
+}
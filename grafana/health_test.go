@@ -0,0 +1,90 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package grafana
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// healthServer fakes a Grafana instance answering /api/health with health and accepting the api token 1234
+func healthServer(healthCode int, health string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/health":
+			w.WriteHeader(healthCode)
+			fmt.Fprint(w, health)
+		case "/api/search":
+			if r.Header.Get("Authorization") != "Bearer 1234" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, "[]")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestCheckHealth(t *testing.T) {
+	Convey("When checking the health of Grafana", t, func() {
+		ctx := context.Background()
+
+		Convey("A healthy instance accepting the credentials should pass", func() {
+			ts := healthServer(http.StatusOK, `{"database":"ok","version":"10.2.0"}`)
+			defer ts.Close()
+			So(CheckHealth(ctx, Config{URL: ts.URL, APIToken: "1234"}), ShouldBeNil)
+		})
+
+		Convey("Invalid credentials should fail", func() {
+			ts := healthServer(http.StatusOK, `{"database":"ok","version":"10.2.0"}`)
+			defer ts.Close()
+			So(CheckHealth(ctx, Config{URL: ts.URL, APIToken: "5678"}), ShouldNotBeNil)
+		})
+
+		Convey("An instance without configured credentials should pass without a search", func() {
+			ts := healthServer(http.StatusOK, `{"database":"ok","version":"10.2.0"}`)
+			defer ts.Close()
+			So(CheckHealth(ctx, Config{URL: ts.URL}), ShouldBeNil)
+		})
+
+		Convey("A failing database should fail", func() {
+			ts := healthServer(http.StatusServiceUnavailable, `{"database":"failing"}`)
+			defer ts.Close()
+			err := CheckHealth(ctx, Config{URL: ts.URL, APIToken: "1234"})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "failing")
+		})
+
+		Convey("Instances without health endpoint should be checked by their credentials", func() {
+			ts := healthServer(http.StatusNotFound, "")
+			defer ts.Close()
+			So(CheckHealth(ctx, Config{URL: ts.URL, APIToken: "1234"}), ShouldBeNil)
+		})
+
+		Convey("An unreachable instance should fail", func() {
+			ts := healthServer(http.StatusOK, "")
+			ts.Close()
+			So(CheckHealth(ctx, Config{URL: ts.URL, APIToken: "1234"}), ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,143 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package grafana
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+)
+
+// DashboardVersion describes a saved revision of a dashboard
+type DashboardVersion struct {
+	ID        int    `json:"id"`
+	Version   int    `json:"version"`
+	Created   string `json:"created"`
+	CreatedBy string `json:"createdBy"`
+	Message   string `json:"message"`
+}
+
+// dashboardVersion is a dashboard revision as returned by the Grafana dashboard versions api
+type dashboardVersion struct {
+	DashboardVersion
+	Data json.RawMessage `json:"data"`
+}
+
+// versionGetter is implemented by the clients able to fetch historical dashboard revisions
+type versionGetter interface {
+	GetDashboardVersion(ctx context.Context, dashName string, version int) (Dashboard, error)
+}
+
+// versionClient fetches a historical revision of dashboards instead of the current one
+type versionClient struct {
+	Client
+	version int
+}
+
+// NewVersionClient wraps c to return revision version of every dashboard requested.
+// Only the Grafana 5 (uid based) clients can fetch dashboard revisions.
+func NewVersionClient(c Client, version int) Client {
+	return versionClient{c, version}
+}
+
+func (v versionClient) GetDashboard(ctx context.Context, dashName string) (Dashboard, error) {
+	vg, ok := v.Client.(versionGetter)
+	if !ok {
+		return Dashboard{}, errors.New("dashboard versions are not supported by this client")
+	}
+	return vg.GetDashboardVersion(ctx, dashName, v.version)
+}
+
+// GetDashboardVersion fetches revision version of a dashboard. The panels of the revision are
+// still rendered by Grafana from the current dashboard, matched by panel id.
+func (g client) GetDashboardVersion(ctx context.Context, dashName string, version int) (Dashboard, error) {
+	if g.getVersionsEndpoint == nil {
+		return Dashboard{}, errors.New("dashboard versions need the Grafana 5 uid based api")
+	}
+	endpoint := g.getVersionsEndpoint(dashName)
+	dv, err := g.getVersion(ctx, endpoint+"/"+strconv.Itoa(version))
+	if err != nil || dv.Version != version {
+		//Grafana before 11 identifies revisions by their id rather than their version number
+		slog.DebugContext(ctx, "looking up dashboard version id", "dashboard", dashName, "version", version)
+		var id int
+		id, err = g.versionID(ctx, endpoint, version)
+		if err == nil {
+			dv, err = g.getVersion(ctx, endpoint+"/"+strconv.Itoa(id))
+		}
+	}
+	if err != nil {
+		return Dashboard{}, err
+	}
+
+	dash, err := ParseDashboard(dv.Data, g.variables)
+	if err != nil {
+		return Dashboard{}, fmt.Errorf("error parsing version %d of dashboard %v: %v", version, dashName, err)
+	}
+	dash.Version = &dv.DashboardVersion
+	slog.DebugContext(ctx, "populated dashboard version", "title", dash.Title, "version", version, "panels", len(dash.Panels))
+	return dash, nil
+}
+
+func (g client) getVersion(ctx context.Context, versionURL string) (dashboardVersion, error) {
+	var dv dashboardVersion
+	body, err := g.getAPI(ctx, "getDashboardVersion", withQuery(versionURL, g.OrgID, nil))
+	if err != nil {
+		return dv, err
+	}
+	err = json.Unmarshal(body, &dv)
+	if err != nil {
+		return dv, fmt.Errorf("error parsing dashboard version: %v", err)
+	}
+	return dv, nil
+}
+
+// versionID finds the id of revision version in the list of revisions of a dashboard
+func (g client) versionID(ctx context.Context, versionsURL string, version int) (int, error) {
+	body, err := g.getAPI(ctx, "getDashboardVersions", withQuery(versionsURL, g.OrgID, nil))
+	if err != nil {
+		return 0, err
+	}
+	var versions []DashboardVersion
+	if json.Unmarshal(body, &versions) != nil {
+		//Grafana 11 and newer page the list of versions
+		var page struct {
+			Versions []DashboardVersion `json:"versions"`
+		}
+		err = json.Unmarshal(body, &page)
+		if err != nil {
+			return 0, fmt.Errorf("error parsing dashboard versions: %v", err)
+		}
+		versions = page.Versions
+	}
+	for _, v := range versions {
+		if v.Version == version {
+			return v.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("dashboard has no version %d", version)
+}
+
+func (a autoClient) GetDashboardVersion(ctx context.Context, dashName string, version int) (Dashboard, error) {
+	c, err := a.client(ctx)
+	if err != nil {
+		return Dashboard{}, err
+	}
+	return versionClient{c, version}.GetDashboard(ctx, dashName)
+}
@@ -0,0 +1,81 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package grafana
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const versionJSON = `{"id": %d, "version": 3, "created": "2024-05-01T10:00:00Z", "createdBy": "alice", "message": "move panels",
+	"data": {"uid": "abc", "title": "Ops", "panels": [{"type": "graph", "id": 1}, {"type": "graph", "id": 2}]}}`
+
+func TestDashboardVersions(t *testing.T) {
+	Convey("When fetching a dashboard version", t, func() {
+		var requested []string
+		byID := false
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requested = append(requested, r.URL.Path)
+			switch {
+			case !byID && r.URL.Path == "/api/dashboards/uid/abc/versions/3":
+				fmt.Fprintf(w, versionJSON, 12)
+			case byID && r.URL.Path == "/api/dashboards/uid/abc/versions":
+				fmt.Fprint(w, `[{"id": 12, "version": 3}, {"id": 11, "version": 2}]`)
+			case byID && r.URL.Path == "/api/dashboards/uid/abc/versions/12":
+				fmt.Fprintf(w, versionJSON, 12)
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+		defer ts.Close()
+		grf := NewVersionClient(NewV5Client(Config{URL: ts.URL}, url.Values{}), 3)
+
+		Convey("It should fetch the revision by version number", func() {
+			dash, err := grf.GetDashboard(context.Background(), "abc")
+			So(err, ShouldBeNil)
+			So(requested, ShouldResemble, []string{"/api/dashboards/uid/abc/versions/3"})
+			So(dash.Title, ShouldEqual, "Ops")
+			So(dash.Panels, ShouldHaveLength, 2)
+			So(dash.Version.Version, ShouldEqual, 3)
+			So(dash.Version.CreatedBy, ShouldEqual, "alice")
+		})
+
+		Convey("It should look up the revision id for Grafana versions identifying revisions by id", func() {
+			byID = true
+			dash, err := grf.GetDashboard(context.Background(), "abc")
+			So(err, ShouldBeNil)
+			So(requested[len(requested)-1], ShouldEqual, "/api/dashboards/uid/abc/versions/12")
+			So(dash.Version.Version, ShouldEqual, 3)
+		})
+
+		Convey("It should fail for unknown versions", func() {
+			_, err := NewVersionClient(NewV5Client(Config{URL: ts.URL}, url.Values{}), 9).GetDashboard(context.Background(), "abc")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("It should fail for the Grafana 4 client", func() {
+			_, err := NewVersionClient(NewV4Client(Config{URL: ts.URL}, url.Values{}), 3).GetDashboard(context.Background(), "abc")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
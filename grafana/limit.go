@@ -0,0 +1,194 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package grafana
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// ErrRenderQueueFull is returned for panel renders that can not wait for a render slot as too many are waiting already
+var ErrRenderQueueFull = errors.New("too many panel renders are waiting, retry later")
+
+// RenderLimiter limits the panel renders in flight across all clients sharing it.
+// Renders waiting for a slot are queued per caller and callers take turns,
+// so a caller rendering a large dashboard does not starve the others.
+type RenderLimiter struct {
+	mu       sync.Mutex
+	size     int
+	free     int
+	maxQueue int
+	queued   int
+	waiting  map[string][]chan struct{}
+	turns    []string //callers with waiting renders, in turn order
+}
+
+// NewRenderLimiter allows concurrency renders at the same time, with at most queueSize renders waiting
+func NewRenderLimiter(concurrency, queueSize int) *RenderLimiter {
+	return &RenderLimiter{
+		size:     concurrency,
+		free:     concurrency,
+		maxQueue: queueSize,
+		waiting:  make(map[string][]chan struct{}),
+	}
+}
+
+// Full reports whether new renders would be rejected
+func (l *RenderLimiter) Full() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.free == 0 && l.queued >= l.maxQueue
+}
+
+// InFlight returns the number of renders holding a render slot
+func (l *RenderLimiter) InFlight() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.size - l.free
+}
+
+// Queued returns the number of renders waiting for a render slot
+func (l *RenderLimiter) Queued() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.queued
+}
+
+// acquire waits for a render slot for caller
+func (l *RenderLimiter) acquire(ctx context.Context, caller string) error {
+	l.mu.Lock()
+	if l.free > 0 && l.queued == 0 {
+		l.free--
+		l.mu.Unlock()
+		return nil
+	}
+	if l.queued >= l.maxQueue {
+		l.mu.Unlock()
+		return ErrRenderQueueFull
+	}
+	ready := make(chan struct{})
+	if len(l.waiting[caller]) == 0 {
+		l.turns = append(l.turns, caller)
+	}
+	l.waiting[caller] = append(l.waiting[caller], ready)
+	l.queued++
+	l.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if !l.dequeue(caller, ready) {
+			//the slot was handed over while giving up, pass it on
+			l.handOver()
+		}
+		return ctx.Err()
+	}
+}
+
+// release frees a render slot, handing it to the caller whose turn it is
+func (l *RenderLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.handOver()
+}
+
+// handOver gives a freed slot to the first waiting render of the next caller in turn
+func (l *RenderLimiter) handOver() {
+	if len(l.turns) == 0 {
+		l.free++
+		return
+	}
+	caller := l.turns[0]
+	l.turns = l.turns[1:]
+	queue := l.waiting[caller]
+	ready := queue[0]
+	l.waiting[caller] = queue[1:]
+	if len(queue) > 1 {
+		l.turns = append(l.turns, caller)
+	} else {
+		delete(l.waiting, caller)
+	}
+	l.queued--
+	close(ready)
+}
+
+// dequeue removes the waiting render ready of caller, returning false if it is not waiting anymore
+func (l *RenderLimiter) dequeue(caller string, ready chan struct{}) bool {
+	queue := l.waiting[caller]
+	for i, r := range queue {
+		if r != ready {
+			continue
+		}
+		l.waiting[caller] = append(queue[:i:i], queue[i+1:]...)
+		l.queued--
+		if len(l.waiting[caller]) == 0 {
+			delete(l.waiting, caller)
+			for j, t := range l.turns {
+				if t == caller {
+					l.turns = append(l.turns[:j:j], l.turns[j+1:]...)
+					break
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// limitedClient takes a render slot of a RenderLimiter for each panel it renders
+type limitedClient struct {
+	Client
+	limiter *RenderLimiter
+	caller  string
+}
+
+// NewLimitedClient wraps c to render panels within the limits of l. caller identifies who the renders are for,
+// renders of different callers take turns.
+func NewLimitedClient(c Client, l *RenderLimiter, caller string) Client {
+	return limitedClient{c, l, caller}
+}
+
+// GetPanelPng holds a render slot until the returned image is closed
+func (c limitedClient) GetPanelPng(ctx context.Context, p Panel, dashName string, t TimeRange) (io.ReadCloser, error) {
+	err := c.limiter.acquire(ctx, c.caller)
+	if err != nil {
+		return nil, err
+	}
+	body, err := c.Client.GetPanelPng(ctx, p, dashName, t)
+	if err != nil {
+		c.limiter.release()
+		return nil, err
+	}
+	return &slotBody{ReadCloser: body, release: c.limiter.release}, nil
+}
+
+// slotBody releases its render slot when closed
+type slotBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *slotBody) Close() error {
+	b.once.Do(b.release)
+	return b.ReadCloser.Close()
+}
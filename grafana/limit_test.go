@@ -0,0 +1,139 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package grafana
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// pngClient renders every panel as the same image
+type pngClient struct {
+	Client
+}
+
+func (pngClient) GetPanelPng(ctx context.Context, p Panel, dashName string, t TimeRange) (io.ReadCloser, error) {
+	return io.NopCloser(strings.NewReader("png")), nil
+}
+
+// acquireAsync waits for a slot of l in the background, sending the caller on got once it has one
+func acquireAsync(l *RenderLimiter, ctx context.Context, caller string, got chan<- string) {
+	go func() {
+		if l.acquire(ctx, caller) == nil {
+			got <- caller
+		}
+	}()
+}
+
+// waitQueued waits until n renders are waiting for a slot of l
+func waitQueued(l *RenderLimiter, n int) {
+	for i := 0; i < 1000; i++ {
+		l.mu.Lock()
+		queued := l.queued
+		l.mu.Unlock()
+		if queued == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRenderLimiter(t *testing.T) {
+	Convey("When panels are rendered through a limited client", t, func() {
+		l := NewRenderLimiter(2, 1)
+		c := NewLimitedClient(pngClient{}, l, "alice")
+		ctx := context.Background()
+
+		first, err := c.GetPanelPng(ctx, Panel{ID: 1}, "dash", TimeRange{})
+		So(err, ShouldBeNil)
+		second, err := c.GetPanelPng(ctx, Panel{ID: 2}, "dash", TimeRange{})
+		So(err, ShouldBeNil)
+
+		Convey("Renders beyond the limit should wait for a slot", func() {
+			got := make(chan string, 1)
+			acquireAsync(l, ctx, "bob", got)
+			waitQueued(l, 1)
+			So(got, ShouldBeEmpty)
+
+			first.Close()
+			So(<-got, ShouldEqual, "bob")
+			second.Close()
+		})
+
+		Convey("Renders beyond the queue size should be rejected", func() {
+			got := make(chan string, 1)
+			acquireAsync(l, ctx, "bob", got)
+			waitQueued(l, 1)
+			So(l.Full(), ShouldBeTrue)
+
+			_, err := c.GetPanelPng(ctx, Panel{ID: 3}, "dash", TimeRange{})
+			So(err, ShouldEqual, ErrRenderQueueFull)
+
+			first.Close()
+			<-got
+			So(l.Full(), ShouldBeFalse)
+			second.Close()
+		})
+
+		Convey("Closing an image twice should free its slot once", func() {
+			first.Close()
+			first.Close()
+			second.Close()
+			So(l.free, ShouldEqual, 2)
+		})
+
+		Convey("A render giving up should leave the queue", func() {
+			cancelCtx, cancel := context.WithCancel(ctx)
+			errs := make(chan error, 1)
+			go func() { errs <- l.acquire(cancelCtx, "bob") }()
+			waitQueued(l, 1)
+			cancel()
+			So(<-errs, ShouldEqual, context.Canceled)
+			So(l.queued, ShouldEqual, 0)
+
+			first.Close()
+			second.Close()
+			So(l.free, ShouldEqual, 2)
+		})
+	})
+
+	Convey("When several callers wait for render slots", t, func() {
+		l := NewRenderLimiter(1, 10)
+		ctx := context.Background()
+		So(l.acquire(ctx, "busy"), ShouldBeNil)
+
+		got := make(chan string, 10)
+		for i, caller := range []string{"alice", "alice", "alice", "bob"} {
+			acquireAsync(l, ctx, caller, got)
+			waitQueued(l, i+1) //queue one at a time to keep the order deterministic
+		}
+
+		Convey("They should take turns", func() {
+			var order []string
+			for i := 0; i < 4; i++ {
+				l.release()
+				order = append(order, <-got)
+			}
+			So(order, ShouldResemble, []string{"alice", "bob", "alice", "alice"})
+		})
+	})
+}
@@ -0,0 +1,144 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package grafana
+
+import (
+	"log/slog"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Repeat directions and the defaults Grafana uses for them
+const (
+	RepeatHorizontal = "h"
+	RepeatVertical   = "v"
+
+	defaultMaxPerRow = 4
+	panelWidth       = 800
+)
+
+// IsRepeated reports whether p is an instance of a panel repeated for a template variable
+func (p Panel) IsRepeated() bool {
+	return p.Repeat != ""
+}
+
+// IsHorizontalRepeat reports whether the instances of p are laid out side by side
+func (p Panel) IsHorizontalRepeat() bool {
+	return p.IsRepeated() && p.RepeatDirection != RepeatVertical
+}
+
+// PerRow returns how many instances of a horizontally repeated panel Grafana shows side by side
+func (p Panel) PerRow(instances int) int {
+	max := p.MaxPerRow
+	if max < 1 {
+		max = defaultMaxPerRow
+	}
+	if instances < max {
+		return instances
+	}
+	return max
+}
+
+// repeatPanels replaces each repeated panel with one instance per effective value of its variable,
+// as the dashboard JSON from the api holds only the panel the instances are repeated from
+func (d Dashboard) repeatPanels(panels []Panel) []Panel {
+	var repeated []Panel
+	for _, p := range panels {
+		if !p.IsRepeated() {
+			repeated = append(repeated, p)
+			continue
+		}
+		values, err := d.ExpandValues(p.Repeat, nil)
+		if err != nil {
+			slog.Warn("unable to repeat panel, rendering it once", "panel", p.ID, "variable", p.Repeat, "error", err)
+			repeated = append(repeated, p)
+			continue
+		}
+		repeated = append(repeated, repeatPanel(p, values)...)
+	}
+	return repeated
+}
+
+// repeatPanel returns one instance of p per value, each rendered with that single value
+func repeatPanel(p Panel, values []string) []Panel {
+	instances := make([]Panel, len(values))
+	for i, value := range values {
+		instance := p.WithScopedVar(p.Repeat, value)
+		instance.RepeatIndex = i
+		if p.IsHorizontalRepeat() {
+			instance.RenderWidth = panelWidth / p.PerRow(len(values))
+		}
+		instances[i] = instance
+	}
+	return instances
+}
+
+// WithScopedVar returns a copy of p rendered with the template variable name set to value
+func (p Panel) WithScopedVar(name, value string) Panel {
+	vars := url.Values{}
+	for k, v := range p.ScopedVars {
+		vars[k] = v
+	}
+	vars.Set("var-"+name, value)
+	p.ScopedVars = vars
+	return p
+}
+
+// repeatRows replaces each repeated row with one instance per effective value of its variable.
+// The panels of each instance are rendered with that single value and its title is interpolated with it.
+func (d Dashboard) repeatRows(rows []Row) []Row {
+	var repeated []Row
+	for _, r := range rows {
+		if r.Repeat == "" {
+			repeated = append(repeated, r)
+			continue
+		}
+		values, err := d.ExpandValues(r.Repeat, nil)
+		if err != nil {
+			slog.Warn("unable to repeat row, rendering it once", "row", r.Title, "variable", r.Repeat, "error", err)
+			repeated = append(repeated, r)
+			continue
+		}
+		v, _ := d.Variable(r.Repeat)
+		for i, value := range values {
+			instance := r
+			instance.Title = interpolate(r.Title, r.Repeat, v.OptionText(value))
+			instance.ScopedVars = url.Values{"var-" + r.Repeat: {value}}
+			instance.RepeatIndex = i
+			instance.Panels = make([]Panel, len(r.Panels))
+			for j, p := range r.Panels {
+				instance.Panels[j] = p.WithScopedVar(r.Repeat, value)
+			}
+			repeated = append(repeated, instance)
+		}
+	}
+	return repeated
+}
+
+// interpolate replaces the references to the template variable name in s with text,
+// in any of the syntaxes Grafana supports: $name, ${name} and [[name]]
+func interpolate(s, name, text string) string {
+	s = strings.ReplaceAll(s, "${"+name+"}", text)
+	s = strings.ReplaceAll(s, "[["+name+"]]", text)
+	return variableRef(name).ReplaceAllLiteralString(s, text)
+}
+
+// variableRef matches $name, but not the start of a longer name like $names
+func variableRef(name string) *regexp.Regexp {
+	return regexp.MustCompile(`\$` + regexp.QuoteMeta(name) + `\b`)
+}
@@ -0,0 +1,195 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package grafana
+
+import (
+	"net/url"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const repeatDashJSON = `
+{"Dashboard":
+	{
+		"Title":"Hosts",
+		"Panels":[
+			{"Type":"graph", "Id":1, "repeat": "host", "maxPerRow": 2},
+			{"Type":"singlestat", "Id":2},
+			{"Type":"graph", "Id":3, "repeat": "host", "repeatDirection": "v"},
+			{"Type":"graph", "Id":4, "repeat": "missing"}
+		],
+		"templating": {"list": [
+			{"name": "host", "current": {"text": "All", "value": "$__all"}, "options": [
+				{"text": "All", "value": "$__all"},
+				{"text": "web1", "value": "web1"},
+				{"text": "web2", "value": "web2"},
+				{"text": "web3", "value": "web3"}
+			]}
+		]}
+	}
+}`
+
+func TestRepeatPanels(t *testing.T) {
+	Convey("When creating a dashboard with repeated panels", t, func() {
+		dash := NewDashboard([]byte(repeatDashJSON), url.Values{})
+
+		Convey("Each repeated panel should be replaced by one instance per value", func() {
+			So(dash.Panels, ShouldHaveLength, 8)
+			for i, host := range []string{"web1", "web2", "web3"} {
+				So(dash.Panels[i].ID, ShouldEqual, 1)
+				So(dash.Panels[i].RepeatIndex, ShouldEqual, i)
+				So(dash.Panels[i].ScopedVars.Get("var-host"), ShouldEqual, host)
+				So(dash.Panels[4+i].ID, ShouldEqual, 3)
+			}
+			So(dash.Panels[3].ID, ShouldEqual, 2)
+		})
+
+		Convey("Horizontal instances should share the panel width per row", func() {
+			So(dash.Panels[0].IsHorizontalRepeat(), ShouldBeTrue)
+			So(dash.Panels[0].PerRow(3), ShouldEqual, 2)
+			So(dash.Panels[0].RenderWidth, ShouldEqual, 400)
+		})
+
+		Convey("Vertical instances should keep the full width", func() {
+			So(dash.Panels[4].IsHorizontalRepeat(), ShouldBeFalse)
+			So(dash.Panels[4].RenderWidth, ShouldEqual, 0)
+		})
+
+		Convey("Requested values should select the instances", func() {
+			dash := NewDashboard([]byte(repeatDashJSON), url.Values{"var-host": {"web2"}})
+			So(dash.Panels, ShouldHaveLength, 4)
+			So(dash.Panels[0].ScopedVars.Get("var-host"), ShouldEqual, "web2")
+			So(dash.Panels[0].RenderWidth, ShouldEqual, 800)
+		})
+
+		Convey("Panels repeated for an unknown variable should be rendered once", func() {
+			So(dash.Panels[7].ID, ShouldEqual, 4)
+			So(dash.Panels[7].ScopedVars, ShouldBeNil)
+		})
+	})
+}
+
+const repeatRowDashJSON = `
+{"Dashboard":
+	{
+		"Title":"Hosts",
+		"Panels":[
+			{"Type":"singlestat", "Id":1},
+			{"Type":"row", "Id":2, "title": "Host $host", "repeat": "host"},
+			{"Type":"graph", "Id":3},
+			{"Type":"graph", "Id":4, "repeat": "disk", "maxPerRow": 2},
+			{"Type":"row", "Id":5, "title": "Summary"},
+			{"Type":"table", "Id":6}
+		],
+		"templating": {"list": [
+			{"name": "host", "current": {"text": ["web1", "web2"], "value": ["web1", "web2"]},
+				"options": [{"text": "web one", "value": "web1"}, {"text": "web two", "value": "web2"}]},
+			{"name": "disk", "current": {"text": ["sda", "sdb"], "value": ["sda", "sdb"]}}
+		]}
+	}
+}`
+
+func TestRepeatRows(t *testing.T) {
+	Convey("When creating a dashboard with repeated rows", t, func() {
+		dash := NewDashboard([]byte(repeatRowDashJSON), url.Values{})
+
+		Convey("Panels should be grouped by row, with one row instance per value", func() {
+			So(dash.Rows, ShouldHaveLength, 4)
+			So(dash.Rows[0].Title, ShouldEqual, "")
+			So(dash.Rows[0].IsRepeated(), ShouldBeFalse)
+			So(dash.Rows[3].Title, ShouldEqual, "Summary")
+			So(dash.Rows[3].IsRepeated(), ShouldBeFalse)
+			So(dash.HasRepeatedRows(), ShouldBeTrue)
+		})
+
+		Convey("Row instance titles should be interpolated with the option text", func() {
+			So(dash.Rows[1].Title, ShouldEqual, "Host web one")
+			So(dash.Rows[2].Title, ShouldEqual, "Host web two")
+			So(dash.Rows[2].RepeatIndex, ShouldEqual, 1)
+		})
+
+		Convey("Row instance panels should be rendered with the row's value", func() {
+			So(dash.Rows[1].Panels, ShouldHaveLength, 3)
+			for _, p := range dash.Rows[2].Panels {
+				So(p.ScopedVars.Get("var-host"), ShouldEqual, "web2")
+			}
+			So(dash.Rows[2].Panels[2].ScopedVars.Get("var-disk"), ShouldEqual, "sdb")
+		})
+
+		Convey("Panels should contain the panels of all rows in order", func() {
+			So(dash.Panels, ShouldHaveLength, 8)
+			So(dash.Panels[0].ID, ShouldEqual, 1)
+			So(dash.Panels[4].ID, ShouldEqual, 3)
+			So(dash.Panels[7].ID, ShouldEqual, 6)
+		})
+	})
+}
+
+const collapsedRowDashJSON = `
+{"Dashboard":
+	{
+		"Title":"Hosts",
+		"Panels":[
+			{"Type":"row", "Id":1, "title": "Host $host", "repeat": "host", "collapsed": true, "panels": [
+				{"Type":"graph", "Id":2},
+				{"Type":"singlestat", "Id":3}
+			]},
+			{"Type":"row", "Id":4, "title": "Summary", "collapsed": true, "panels": [
+				{"Type":"table", "Id":5}
+			]}
+		],
+		"templating": {"list": [
+			{"name": "host", "current": {"text": ["web1", "web2"], "value": ["web1", "web2"]}}
+		]}
+	}
+}`
+
+func TestCollapsedRows(t *testing.T) {
+	Convey("When creating a dashboard with collapsed rows", t, func() {
+		dash := NewDashboard([]byte(collapsedRowDashJSON), url.Values{})
+
+		Convey("The panels nested in a collapsed row should belong to the row", func() {
+			So(dash.Rows, ShouldHaveLength, 3)
+			So(dash.Rows[2].Title, ShouldEqual, "Summary")
+			So(dash.Rows[2].Panels, ShouldHaveLength, 1)
+			So(dash.Rows[2].Panels[0].ID, ShouldEqual, 5)
+		})
+
+		Convey("A collapsed repeated row should be repeated with its panels", func() {
+			So(dash.Rows[0].Title, ShouldEqual, "Host web1")
+			So(dash.Rows[1].Title, ShouldEqual, "Host web2")
+			So(dash.Rows[1].Panels, ShouldHaveLength, 2)
+			for _, p := range dash.Rows[1].Panels {
+				So(p.ScopedVars.Get("var-host"), ShouldEqual, "web2")
+			}
+		})
+
+		Convey("Panels should contain the panels of all rows in order", func() {
+			So(dash.Panels, ShouldHaveLength, 5)
+			So(dash.Panels[0].ID, ShouldEqual, 2)
+			So(dash.Panels[4].ID, ShouldEqual, 5)
+		})
+	})
+}
+
+func TestInterpolate(t *testing.T) {
+	Convey("Variable references should be replaced in all syntaxes", t, func() {
+		So(interpolate("$host / ${host} / [[host]]", "host", "web1"), ShouldEqual, "web1 / web1 / web1")
+		So(interpolate("$hosts $host", "host", "web1"), ShouldEqual, "$hosts web1")
+	})
+}
@@ -0,0 +1,104 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package grafana
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// Search result types understood by the Grafana search API
+const (
+	SearchTypeDashboard = "dash-db"
+	SearchTypeFolder    = "dash-folder"
+)
+
+// SearchQuery selects dashboards through the Grafana search API. Empty fields are not filtered on.
+type SearchQuery struct {
+	Query string
+	// Tags only matches dashboards carrying all of the given tags
+	Tags       []string
+	FolderUIDs []string
+	Type       string
+	Limit      int
+}
+
+// SearchResult is a dashboard or folder found by the Grafana search API
+type SearchResult struct {
+	ID          int      `json:"id"`
+	UID         string   `json:"uid,omitempty"`
+	Title       string   `json:"title"`
+	URI         string   `json:"uri,omitempty"`
+	URL         string   `json:"url,omitempty"`
+	Type        string   `json:"type"`
+	Tags        []string `json:"tags"`
+	FolderUID   string   `json:"folderUid,omitempty"`
+	FolderTitle string   `json:"folderTitle,omitempty"`
+	// DashName is the identifier GetDashboard expects for this dashboard:
+	// the slug for Grafana 4 and older and the uid for Grafana 5 and newer
+	DashName string `json:"dashName"`
+}
+
+func (q SearchQuery) values() url.Values {
+	vals := url.Values{}
+	if q.Query != "" {
+		vals.Set("query", q.Query)
+	}
+	for _, t := range q.Tags {
+		vals.Add("tag", t)
+	}
+	for _, f := range q.FolderUIDs {
+		vals.Add("folderUIDs", f)
+	}
+	if q.Type != "" {
+		vals.Set("type", q.Type)
+	}
+	if q.Limit > 0 {
+		vals.Set("limit", strconv.Itoa(q.Limit))
+	}
+	return vals
+}
+
+func (g client) SearchDashboards(ctx context.Context, q SearchQuery) ([]SearchResult, error) {
+	body, err := g.getAPI(ctx, "searchDashboards", withQuery(g.URL+"/api/search", g.OrgID, q.values()))
+	if err != nil {
+		return nil, err
+	}
+
+	var results []SearchResult
+	err = json.Unmarshal(body, &results)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing search results: %v", err)
+	}
+	for i, r := range results {
+		if r.Type == SearchTypeDashboard {
+			results[i].DashName = g.searchDashName(r)
+		}
+	}
+	return results, nil
+}
+
+func (a autoClient) SearchDashboards(ctx context.Context, q SearchQuery) ([]SearchResult, error) {
+	c, err := a.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.SearchDashboards(ctx, q)
+}
@@ -0,0 +1,77 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package grafana
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestGrafanaClientSearchesDashboards(t *testing.T) {
+	Convey("When searching dashboards", t, func() {
+		var query url.Values
+		path := ""
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path = r.URL.Path
+			query = r.URL.Query()
+			fmt.Fprintln(w, `[
+				{"id":1,"uid":"abc","title":"SLA","uri":"db/sla","type":"dash-db","tags":["sla"],"folderUid":"f1","folderTitle":"Ops"},
+				{"id":2,"uid":"f1","title":"Ops","uri":"db/ops","type":"dash-folder","tags":[]}
+			]`)
+		}))
+		defer ts.Close()
+
+		q := SearchQuery{Query: "SLA", Tags: []string{"sla", "prod"}, FolderUIDs: []string{"f1"}, Type: SearchTypeDashboard, Limit: 10}
+
+		Convey("It should pass the query to the search api", func() {
+			NewV5Client(Config{URL: ts.URL, OrgID: 2}, url.Values{}).SearchDashboards(context.Background(), q)
+			So(path, ShouldEqual, "/api/search")
+			So(query.Get("query"), ShouldEqual, "SLA")
+			So(query["tag"], ShouldResemble, []string{"sla", "prod"})
+			So(query.Get("folderUIDs"), ShouldEqual, "f1")
+			So(query.Get("type"), ShouldEqual, "dash-db")
+			So(query.Get("limit"), ShouldEqual, "10")
+			So(query.Get("orgId"), ShouldEqual, "2")
+		})
+
+		Convey("The v5 client should identify dashboards by uid", func() {
+			results, err := NewV5Client(Config{URL: ts.URL}, url.Values{}).SearchDashboards(context.Background(), q)
+			So(err, ShouldBeNil)
+			So(results, ShouldHaveLength, 2)
+			So(results[0].Title, ShouldEqual, "SLA")
+			So(results[0].FolderTitle, ShouldEqual, "Ops")
+			So(results[0].DashName, ShouldEqual, "abc")
+		})
+
+		Convey("The v4 client should identify dashboards by slug", func() {
+			results, err := NewV4Client(Config{URL: ts.URL}, url.Values{}).SearchDashboards(context.Background(), q)
+			So(err, ShouldBeNil)
+			So(results[0].DashName, ShouldEqual, "sla")
+		})
+
+		Convey("Folders should not get a dashboard name", func() {
+			results, _ := NewV5Client(Config{URL: ts.URL}, url.Values{}).SearchDashboards(context.Background(), q)
+			So(results[1].DashName, ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,44 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package grafana
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// NewSnapshotClient creates a Client reporting on Grafana snapshots, identified by their snapshot key,
+// for the Grafana instance described by cfg.
+// Snapshots hold the data of their panels, which are rendered with the time range the snapshot was taken with.
+// As anyone knowing its key can view a snapshot, keys are redacted from the logged urls.
+func NewSnapshotClient(cfg Config, variables url.Values) Client {
+	getDashEndpoint := func(key string) string {
+		return withQuery(cfg.URL+"/api/snapshots/"+key, cfg.OrgID, nil)
+	}
+
+	getPanelEndpoint := func(key string, vals url.Values) string {
+		//the frozen data only covers the time range of the snapshot
+		vals.Del("from")
+		vals.Del("to")
+		return fmt.Sprintf("%s/render/dashboard-solo/snapshot/%s?%s", cfg.URL, key, vals.Encode())
+	}
+
+	searchDashName := func(r SearchResult) string {
+		return r.UID
+	}
+	return client{cfg, getDashEndpoint, getPanelEndpoint, searchDashName, nil, variables, []string{"snapshots", "snapshot"}}
+}
@@ -0,0 +1,69 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package grafana
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSnapshotClient(t *testing.T) {
+	Convey("When reporting on a Grafana snapshot", t, func() {
+		var requestURI string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestURI = r.RequestURI
+			fmt.Fprint(w, `{"dashboard": {"title": "Incident 42", "panels": [{"type": "graph", "id": 3, "snapshotData": []}]}, "meta": {"isSnapshot": true}}`)
+		}))
+		defer ts.Close()
+		grf := NewSnapshotClient(Config{URL: ts.URL, OrgID: 2}, url.Values{"var-host": {"web1"}})
+
+		Convey("It should fetch the dashboard from the snapshot api", func() {
+			dash, err := grf.GetDashboard(context.Background(), "s3cr3tk3y")
+			So(err, ShouldBeNil)
+			So(requestURI, ShouldEqual, "/api/snapshots/s3cr3tk3y?orgId=2")
+			So(dash.Title, ShouldEqual, "Incident 42")
+			So(dash.Panels, ShouldHaveLength, 1)
+		})
+
+		Convey("It should render panels from the snapshot with its own time range", func() {
+			_, err := grf.GetPanelPng(context.Background(), Panel{ID: 3, Type: "graph"}, "s3cr3tk3y", TimeRange{"now-1h", "now"})
+			So(err, ShouldBeNil)
+			So(requestURI, ShouldStartWith, "/render/dashboard-solo/snapshot/s3cr3tk3y?")
+			So(requestURI, ShouldContainSubstring, "panelId=3")
+			So(requestURI, ShouldNotContainSubstring, "from=")
+			So(requestURI, ShouldNotContainSubstring, "to=")
+		})
+
+		Convey("Errors should not reveal the snapshot key", func() {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "snapshot not found", http.StatusNotFound)
+			}))
+			defer ts.Close()
+			grf := NewSnapshotClient(Config{URL: ts.URL}, url.Values{})
+			_, err := grf.GetDashboard(context.Background(), "s3cr3tk3y")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "/api/snapshots/REDACTED")
+			So(err.Error(), ShouldNotContainSubstring, "s3cr3tk3y")
+		})
+	})
+}
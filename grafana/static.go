@@ -0,0 +1,38 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package grafana
+
+import (
+	"context"
+)
+
+// staticClient returns a dashboard definition given up front instead of fetching it,
+// while panels are still rendered by the wrapped client
+type staticClient struct {
+	Client
+	dash Dashboard
+}
+
+// NewStaticDashboardClient wraps c to return dash for every dashboard requested,
+// e.g. to render a dashboard definition that is not saved in Grafana
+func NewStaticDashboardClient(c Client, dash Dashboard) Client {
+	return staticClient{c, dash}
+}
+
+func (s staticClient) GetDashboard(ctx context.Context, dashName string) (Dashboard, error) {
+	return s.dash, nil
+}
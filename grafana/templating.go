@@ -0,0 +1,166 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package grafana
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// AllValue is the value Grafana uses for the All option of a template variable
+const AllValue = "$__all"
+
+// Variable hide settings, as stored in the Grafana JSON structure
+const (
+	HideNothing = iota
+	HideLabel
+	HideVariable
+)
+
+// Variable is a dashboard template variable
+type Variable struct {
+	Name    string
+	Label   string
+	Type    string
+	Hide    int
+	Current VariableCurrent
+	Options []VariableOption
+	// Values are the effective values of the variable: the values given in the request,
+	// or the dashboard's current values if the request did not set the variable.
+	// Not present in the Grafana JSON structure
+	Values []string `json:"-"`
+}
+
+// VariableCurrent is the value a template variable was saved with
+type VariableCurrent struct {
+	Text  stringList
+	Value stringList
+}
+
+// VariableOption is one of the values a template variable can take
+type VariableOption struct {
+	Text  string
+	Value string
+}
+
+// stringList reads JSON values that Grafana stores either as a single string or as a list of strings
+type stringList []string
+
+func (s *stringList) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*s = stringList{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("expected a string or a list of strings: %v", err)
+	}
+	*s = list
+	return nil
+}
+
+// DisplayName returns the label of the variable, or its name if it has no label
+func (v Variable) DisplayName() string {
+	if v.Label != "" {
+		return v.Label
+	}
+	return v.Name
+}
+
+// DisplayText returns the effective values as shown by Grafana, using the option texts where known
+func (v Variable) DisplayText() string {
+	texts := make([]string, len(v.Values))
+	for i, value := range v.Values {
+		texts[i] = v.OptionText(value)
+	}
+	return strings.Join(texts, ", ")
+}
+
+// OptionText returns the display text of one value of the variable
+func (v Variable) OptionText(value string) string {
+	for _, o := range v.Options {
+		if o.Value == value && o.Text != "" {
+			return o.Text
+		}
+	}
+	if value == AllValue {
+		return "All"
+	}
+	return value
+}
+
+// Variable returns the template variable called name, with or without the var- prefix
+func (d Dashboard) Variable(name string) (Variable, bool) {
+	name = strings.TrimPrefix(name, "var-")
+	for _, v := range d.Variables {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return Variable{}, false
+}
+
+// ExpandValues returns the individual values selected for the template variable called name.
+// requested are the values given in the request, when none are given the dashboard's current values are used.
+// If the All option is selected or no value is known, every option stored in the dashboard is returned.
+func (d Dashboard) ExpandValues(name string, requested []string) ([]string, error) {
+	v, ok := d.Variable(name)
+	if len(requested) == 0 {
+		requested = v.Values
+	}
+	all := len(requested) == 0
+	for _, r := range requested {
+		if r == AllValue || r == "All" {
+			all = true
+		}
+	}
+	if !all {
+		return requested, nil
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("dashboard has no template variable %v", name)
+	}
+	var values []string
+	for _, o := range v.Options {
+		if o.Value != AllValue {
+			values = append(values, o.Value)
+		}
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("template variable %v has no options stored in the dashboard, request its values explicitly", name)
+	}
+	return values, nil
+}
+
+// mergeVariables sets the effective values of the dashboard's template variables,
+// preferring the values of the request over the values the dashboard was saved with
+func mergeVariables(list []Variable, requested url.Values) []Variable {
+	merged := make([]Variable, len(list))
+	for i, v := range list {
+		if r, ok := requested["var-"+v.Name]; ok {
+			v.Values = append([]string(nil), r...)
+		} else {
+			v.Values = append([]string(nil), v.Current.Value...)
+		}
+		merged[i] = v
+	}
+	return merged
+}
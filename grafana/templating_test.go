@@ -0,0 +1,130 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package grafana
+
+import (
+	"net/url"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const templatedDashJSON = `
+{"Dashboard":
+	{
+		"Title":"Hosts",
+		"Panels":[{"Type":"graph", "Id":1}],
+		"templating": {"list": [
+			{"name": "host", "options": [
+				{"text": "All", "value": "$__all"},
+				{"text": "web one", "value": "web1"},
+				{"text": "web two", "value": "web2"}
+			]},
+			{"name": "dc", "options": []},
+			{"name": "env", "label": "Environment", "type": "custom", "hide": 1,
+				"current": {"text": "Production", "value": "prod"},
+				"options": [{"text": "Production", "value": "prod"}, {"text": "Staging", "value": "stage"}]},
+			{"name": "region", "type": "query",
+				"current": {"text": ["eu", "us"], "value": ["eu", "us"]}},
+			{"name": "secret", "type": "constant", "hide": 2, "current": {"text": "s", "value": "s"}}
+		]}
+	}
+}`
+
+func TestExpandValues(t *testing.T) {
+	Convey("When expanding the values of a template variable", t, func() {
+		dash := NewDashboard([]byte(templatedDashJSON), url.Values{})
+
+		Convey("The templating list should be parsed", func() {
+			So(dash.Variables, ShouldHaveLength, 5)
+			v, ok := dash.Variable("var-host")
+			So(ok, ShouldBeTrue)
+			So(v.Options[1], ShouldResemble, VariableOption{Text: "web one", Value: "web1"})
+		})
+
+		Convey("Requested values should be used as given", func() {
+			values, err := dash.ExpandValues("host", []string{"web2", "web3"})
+			So(err, ShouldBeNil)
+			So(values, ShouldResemble, []string{"web2", "web3"})
+		})
+
+		Convey("All should resolve to every option except All itself", func() {
+			values, err := dash.ExpandValues("host", []string{AllValue})
+			So(err, ShouldBeNil)
+			So(values, ShouldResemble, []string{"web1", "web2"})
+		})
+
+		Convey("No requested values should resolve to every option", func() {
+			values, err := dash.ExpandValues("host", nil)
+			So(err, ShouldBeNil)
+			So(values, ShouldResemble, []string{"web1", "web2"})
+		})
+
+		Convey("No requested values should resolve to the saved selection if there is one", func() {
+			values, err := dash.ExpandValues("region", nil)
+			So(err, ShouldBeNil)
+			So(values, ShouldResemble, []string{"eu", "us"})
+		})
+
+		Convey("It should fail for unknown variables and variables without stored options", func() {
+			_, err := dash.ExpandValues("missing", nil)
+			So(err, ShouldNotBeNil)
+			_, err = dash.ExpandValues("dc", []string{AllValue})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestVariableDefaults(t *testing.T) {
+	Convey("When merging requested variables with the dashboard templating", t, func() {
+		dash := NewDashboard([]byte(templatedDashJSON), url.Values{"var-region": {"ap"}, "var-other": {"x"}})
+
+		Convey("Variable definitions should be parsed", func() {
+			env, _ := dash.Variable("env")
+			So(env.Label, ShouldEqual, "Environment")
+			So(env.Type, ShouldEqual, "custom")
+			So(env.Hide, ShouldEqual, HideLabel)
+			So(env.Current.Text, ShouldResemble, stringList{"Production"})
+			So(env.DisplayName(), ShouldEqual, "Environment")
+		})
+
+		Convey("Variables missing from the request should take their saved values", func() {
+			env, _ := dash.Variable("env")
+			So(env.Values, ShouldResemble, []string{"prod"})
+			So(env.DisplayText(), ShouldEqual, "Production")
+		})
+
+		Convey("Requested values should override the saved values", func() {
+			region, _ := dash.Variable("region")
+			So(region.Values, ShouldResemble, []string{"ap"})
+			So(region.DisplayName(), ShouldEqual, "region")
+		})
+
+		Convey("Hidden variables and variables without values should not be visible", func() {
+			var names []string
+			for _, v := range dash.VisibleVariables() {
+				names = append(names, v.Name)
+			}
+			So(names, ShouldResemble, []string{"env", "region"})
+		})
+
+		Convey("The All value should be shown as All", func() {
+			v := Variable{Values: []string{AllValue}}
+			So(v.DisplayText(), ShouldEqual, "All")
+		})
+	})
+}
@@ -17,8 +17,7 @@
 package grafana
 
 import (
-	"io/ioutil"
-	"log"
+	"fmt"
 	"regexp"
 	"strconv"
 	"time"
@@ -55,10 +54,6 @@ const (
 	dashTimeFormat     = "_02.01.2006-15h"
 )
 
-func init() {
-	log.SetOutput(ioutil.Discard)
-}
-
 func NewTimeRange(from, to string) TimeRange {
 	if from == "" {
 		from = "now-1h"
@@ -69,6 +64,20 @@ func NewTimeRange(from, to string) TimeRange {
 	return TimeRange{from, to}
 }
 
+// Validate returns an error if the From or To time spec of tr is not recognised
+func (tr TimeRange) Validate() (err error) {
+	defer func() {
+		//the time parser panics on unrecognised time specifications
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid time range: %v", r)
+		}
+	}()
+	n := newNow()
+	n.parseFrom(tr.From)
+	n.parseTo(tr.To)
+	return nil
+}
+
 // Formats Grafana 'From' time spec into absolute printable time
 func (tr TimeRange) FromFormatted() string {
 	n := newNow()
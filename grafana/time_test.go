@@ -203,3 +203,16 @@ func TestTimeParsing(tst *testing.T) {
 
 	})
 }
+
+func TestTimeRangeValidation(t *testing.T) {
+	Convey("When validating time ranges", t, func() {
+		Convey("Recognised time specs should be valid", func() {
+			So(TimeRange{"now-1d/d", "1453997672000"}.Validate(), ShouldBeNil)
+		})
+
+		Convey("Unrecognised time specs should be invalid", func() {
+			So(TimeRange{"yesterday", "now"}.Validate(), ShouldNotBeNil)
+			So(TimeRange{"now-1h", "now-1x"}.Validate(), ShouldNotBeNil)
+		})
+	})
+}
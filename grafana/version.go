@@ -0,0 +1,195 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package grafana
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+// Version is a Grafana server version
+type Version struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// AtLeast reports whether v is the same as or newer than major.minor
+func (v Version) AtLeast(major, minor int) bool {
+	return v.Major > major || v.Major == major && v.Minor >= minor
+}
+
+var versionRegExp = regexp.MustCompile(`^v?(\d+)\.(\d+)(?:\.(\d+))?`)
+
+// ParseVersion parses Grafana version strings such as 4.6.3, 7.5.0-beta1 or 10.0.0-preview
+func ParseVersion(s string) (Version, error) {
+	m := versionRegExp.FindStringSubmatch(s)
+	if m == nil {
+		return Version{}, fmt.Errorf("%q is not a recognised Grafana version", s)
+	}
+	var v Version
+	v.Major, _ = strconv.Atoi(m[1])
+	v.Minor, _ = strconv.Atoi(m[2])
+	if m[3] != "" {
+		v.Patch, _ = strconv.Atoi(m[3])
+	}
+	return v, nil
+}
+
+// versions caches the detected version of each Grafana instance by url
+var versions = struct {
+	sync.Mutex
+	m map[string]Version
+}{m: map[string]Version{}}
+
+// DetectVersion returns the version of the Grafana instance described by cfg.
+// The instance is probed once, on /api/health and then on /api/frontend/settings,
+// and the version is cached for subsequent calls. Failed probes are not cached.
+func DetectVersion(ctx context.Context, cfg Config) (Version, error) {
+	versions.Lock()
+	v, ok := versions.m[cfg.URL]
+	versions.Unlock()
+	if ok {
+		return v, nil
+	}
+
+	g := client{Config: cfg}
+	raw, err := g.probeVersion(ctx, "/api/health", func(body []byte) (string, error) {
+		var health struct{ Version string }
+		err := json.Unmarshal(body, &health)
+		return health.Version, err
+	})
+	if err != nil {
+		slog.DebugContext(ctx, "grafana health endpoint did not report a version", "error", err)
+		raw, err = g.probeVersion(ctx, "/api/frontend/settings", func(body []byte) (string, error) {
+			var settings struct{ BuildInfo struct{ Version string } }
+			err := json.Unmarshal(body, &settings)
+			return settings.BuildInfo.Version, err
+		})
+	}
+	if err != nil {
+		return Version{}, fmt.Errorf("error detecting grafana version: %v", err)
+	}
+	v, err = ParseVersion(raw)
+	if err != nil {
+		return Version{}, fmt.Errorf("error detecting grafana version: %v", err)
+	}
+
+	slog.InfoContext(ctx, "detected grafana version", "version", v.String())
+	versions.Lock()
+	versions.m[cfg.URL] = v
+	versions.Unlock()
+	return v, nil
+}
+
+func (g client) probeVersion(ctx context.Context, endpoint string, parse func([]byte) (string, error)) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", g.URL+endpoint, nil)
+	if err != nil {
+		return "", fmt.Errorf("error creating request for %v: %v", endpoint, err)
+	}
+	g.authorize(req)
+	resp, err := g.httpClient().Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error executing request for %v: %v", endpoint, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading response body from %v: %v", endpoint, err)
+	}
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("error probing %v. Got Status %v", endpoint, resp.Status)
+	}
+	v, err := parse(body)
+	if err != nil {
+		return "", fmt.Errorf("error parsing response from %v: %v", endpoint, err)
+	}
+	if v == "" {
+		return "", fmt.Errorf("%v did not report a version", endpoint)
+	}
+	return v, nil
+}
+
+// autoClient picks the Grafana 4 or Grafana 5+ endpoints based on the detected Grafana version
+type autoClient struct {
+	cfg       Config
+	variables url.Values
+}
+
+// NewAutoClient creates a Client that detects the version of the Grafana instance described by cfg
+// on first use and then behaves like the Client returned by NewV4Client or NewV5Client.
+// Dashboards are identified by slug on Grafana 4 and older, and by uid on Grafana 5 and newer.
+// Render options the detected version does not support are dropped, see Version.RenderOptions.
+func NewAutoClient(cfg Config, variables url.Values) Client {
+	return autoClient{cfg, variables}
+}
+
+func (a autoClient) client(ctx context.Context) (Client, error) {
+	v, err := DetectVersion(ctx, a.cfg)
+	if err != nil {
+		return nil, err
+	}
+	cfg := a.cfg
+	cfg.Render = v.RenderOptions(cfg.Render)
+	if !v.AtLeast(5, 0) {
+		return NewV4Client(cfg, a.variables), nil
+	}
+	return NewV5Client(cfg, a.variables), nil
+}
+
+// RenderOptions returns o without the render parameters Grafana v does not know, so panels are rendered
+// with the defaults of v instead: the tz parameter was added in Grafana 5.1 and the scale parameter,
+// the device scale factor of the image renderer, in Grafana 7.0. All other parameters are known to every version.
+func (v Version) RenderOptions(o RenderOptions) RenderOptions {
+	if !v.AtLeast(5, 1) {
+		o.Timezone = ""
+	}
+	if !v.AtLeast(7, 0) {
+		o.Scale = 0
+	}
+	return o
+}
+
+func (a autoClient) GetDashboard(ctx context.Context, dashName string) (Dashboard, error) {
+	c, err := a.client(ctx)
+	if err != nil {
+		return Dashboard{}, err
+	}
+	return c.GetDashboard(ctx, dashName)
+}
+
+func (a autoClient) GetPanelPng(ctx context.Context, p Panel, dashName string, t TimeRange) (io.ReadCloser, error) {
+	c, err := a.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.GetPanelPng(ctx, p, dashName, t)
+}
@@ -0,0 +1,152 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package grafana
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParseVersion(t *testing.T) {
+	Convey("When parsing Grafana versions", t, func() {
+		Convey("Release versions should be parsed", func() {
+			v, err := ParseVersion("4.6.3")
+			So(err, ShouldBeNil)
+			So(v, ShouldResemble, Version{4, 6, 3})
+		})
+
+		Convey("Pre-release suffixes should be ignored", func() {
+			v, err := ParseVersion("10.0.0-preview")
+			So(err, ShouldBeNil)
+			So(v, ShouldResemble, Version{10, 0, 0})
+		})
+
+		Convey("Unrecognised versions should return an error", func() {
+			_, err := ParseVersion("latest")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("AtLeast should compare major and minor versions", func() {
+			So(Version{5, 0, 0}.AtLeast(5, 0), ShouldBeTrue)
+			So(Version{4, 6, 3}.AtLeast(5, 0), ShouldBeFalse)
+			So(Version{10, 1, 0}.AtLeast(9, 4), ShouldBeTrue)
+		})
+	})
+}
+
+// grafanaServer fakes a Grafana instance that reports version on the given endpoint
+func grafanaServer(versionEndpoint, body string, probes *int, requestURI *string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == versionEndpoint:
+			*probes++
+			fmt.Fprintln(w, body)
+		case strings.HasPrefix(r.URL.Path, "/api/health"), strings.HasPrefix(r.URL.Path, "/api/frontend"):
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			*requestURI = r.RequestURI
+			fmt.Fprintln(w, `{"":""}`)
+		}
+	}))
+}
+
+func TestVersionRenderOptions(t *testing.T) {
+	Convey("When dropping the render options a Grafana version does not support", t, func() {
+		o := RenderOptions{Width: 1000, Scale: 2, Timezone: "UTC", Theme: "dark"}
+		So(Version{4, 6, 3}.RenderOptions(o), ShouldResemble, RenderOptions{Width: 1000, Theme: "dark"})
+		So(Version{5, 1, 0}.RenderOptions(o), ShouldResemble, RenderOptions{Width: 1000, Timezone: "UTC", Theme: "dark"})
+		So(Version{7, 0, 0}.RenderOptions(o), ShouldResemble, o)
+	})
+}
+
+func TestAutoClient(t *testing.T) {
+	Convey("When using the auto detecting client", t, func() {
+		probes := 0
+		requestURI := ""
+
+		Convey("Against Grafana 5 or newer", func() {
+			ts := grafanaServer("/api/health", `{"database":"ok","version":"8.3.3"}`, &probes, &requestURI)
+			defer ts.Close()
+			grf := NewAutoClient(Config{URL: ts.URL}, url.Values{})
+			grf.GetDashboard(context.Background(), "rYy7Paekz")
+
+			Convey("It should use the uid dashboards endpoint", func() {
+				So(requestURI, ShouldEqual, "/api/dashboards/uid/rYy7Paekz")
+			})
+
+			Convey("It should use the d-solo render endpoint", func() {
+				grf.GetPanelPng(context.Background(), Panel{ID: 44, Type: "graph", Title: "title"}, "rYy7Paekz", TimeRange{"now-1h", "now"})
+				So(requestURI, ShouldStartWith, "/render/d-solo/rYy7Paekz/_")
+			})
+
+			Convey("It should probe the version only once", func() {
+				NewAutoClient(Config{URL: ts.URL}, url.Values{}).GetDashboard(context.Background(), "other")
+				So(probes, ShouldEqual, 1)
+			})
+		})
+
+		Convey("Against Grafana 4 without a version in the health endpoint", func() {
+			ts := grafanaServer("/api/frontend/settings", `{"buildInfo":{"version":"4.6.3"}}`, &probes, &requestURI)
+			defer ts.Close()
+			grf := NewAutoClient(Config{URL: ts.URL}, url.Values{})
+			grf.GetDashboard(context.Background(), "testDash")
+
+			Convey("It should fall back to the frontend settings and use the slug dashboards endpoint", func() {
+				So(probes, ShouldEqual, 1)
+				So(requestURI, ShouldEqual, "/api/dashboards/db/testDash")
+			})
+
+			Convey("It should use the dashboard-solo render endpoint", func() {
+				grf.GetPanelPng(context.Background(), Panel{ID: 44, Type: "graph", Title: "title"}, "testDash", TimeRange{"now-1h", "now"})
+				So(requestURI, ShouldStartWith, "/render/dashboard-solo/db/testDash")
+			})
+		})
+
+		Convey("Against Grafana 6 with render options it does not support", func() {
+			ts := grafanaServer("/api/health", `{"database":"ok","version":"6.7.4"}`, &probes, &requestURI)
+			defer ts.Close()
+			cfg := Config{URL: ts.URL, Render: RenderOptions{Scale: 2, Timezone: "Europe/Paris", Theme: "dark"}}
+			NewAutoClient(cfg, url.Values{}).GetPanelPng(context.Background(), Panel{ID: 44, Type: "graph", Title: "title"}, "rYy7Paekz", TimeRange{"now-1h", "now"})
+
+			Convey("It should only send the render parameters of that version", func() {
+				u, err := url.Parse(requestURI)
+				So(err, ShouldBeNil)
+				So(u.Query().Get("tz"), ShouldEqual, "Europe/Paris")
+				So(u.Query().Get("theme"), ShouldEqual, "dark")
+				So(u.Query().Has("scale"), ShouldBeFalse)
+			})
+		})
+
+		Convey("When the version cannot be detected", func() {
+			ts := grafanaServer("/none", "", &probes, &requestURI)
+			defer ts.Close()
+			_, err := NewAutoClient(Config{URL: ts.URL}, url.Values{}).GetDashboard(context.Background(), "testDash")
+
+			Convey("It should return an error without fetching the dashboard", func() {
+				So(err, ShouldNotBeNil)
+				So(requestURI, ShouldBeEmpty)
+			})
+		})
+	})
+}
@@ -0,0 +1,211 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package logging configures the service wide structured logger, tags log
+// records with the id of the request being served and redacts credentials
+// before they are written out.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/pborman/uuid"
+)
+
+// RequestIDHeader is the http header used to read and echo the request id
+const RequestIDHeader = "X-Request-ID"
+
+const redacted = "REDACTED"
+
+type ctxKey struct{}
+
+// credentialParams are query parameters that always carry credentials
+var credentialParams = map[string]bool{
+	"apitoken": true,
+	"apikey":   true,
+	"token":    true,
+	"password": true,
+}
+
+// DefaultSensitiveVariables matches the template variable names whose values are redacted by default
+const DefaultSensitiveVariables = `(?i)(pass|secret|token|key|auth|credential)`
+
+// sensitiveVars matches Grafana template variable names (without the var- prefix)
+// whose values must not be logged
+var sensitiveVars = regexp.MustCompile(DefaultSensitiveVariables)
+
+// Setup replaces the default logger with one writing to w in the given format
+// ("text" or "json"), discarding records below level ("debug", "info", "warn" or "error").
+// Records logged with a context carrying a request id are tagged with it.
+func Setup(w io.Writer, format, level string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q: %v", level, err)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("invalid log format %q, expected text or json", format)
+	}
+	slog.SetDefault(slog.New(contextHandler{h}))
+	return nil
+}
+
+// SetSensitiveVariables replaces the expression used to decide which template
+// variable values are redacted. It is matched against the variable name without the var- prefix.
+func SetSensitiveVariables(expr string) error {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return fmt.Errorf("invalid sensitive variable expression %q: %v", expr, err)
+	}
+	sensitiveVars = re
+	return nil
+}
+
+// contextHandler adds the request id found in the record's context to every record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// WithRequestID returns a copy of ctx carrying the request id
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, id)
+}
+
+// RequestID returns the request id carried by ctx, or the empty string
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(ctxKey{}).(string)
+	return id
+}
+
+// Handler assigns a request id to every request served by next. An id supplied
+// by the caller in the X-Request-ID header is reused, otherwise a new one is generated.
+// The id is echoed back in the response headers.
+func Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := sanitizeRequestID(req.Header.Get(RequestIDHeader))
+		if id == "" {
+			id = uuid.New()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, req.WithContext(WithRequestID(req.Context(), id)))
+	})
+}
+
+// sanitizeRequestID drops caller supplied ids that are too long or could forge log lines
+func sanitizeRequestID(id string) string {
+	if len(id) > 64 {
+		return ""
+	}
+	for _, c := range id {
+		if !(c == '-' || c == '_' || c == '.' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return ""
+		}
+	}
+	return id
+}
+
+// IsSensitive reports whether the value of the query parameter or template
+// variable called name must be redacted
+func IsSensitive(name string) bool {
+	lower := strings.ToLower(name)
+	if credentialParams[lower] {
+		return true
+	}
+	if strings.HasPrefix(lower, "var-") {
+		return sensitiveVars.MatchString(name[len("var-"):])
+	}
+	return false
+}
+
+// RedactValues returns a copy of values with credentials and sensitive variable values replaced
+func RedactValues(values url.Values) url.Values {
+	out := url.Values{}
+	for k, v := range values {
+		for _, singleV := range v {
+			if IsSensitive(k) {
+				singleV = redacted
+			}
+			out.Add(k, singleV)
+		}
+	}
+	return out
+}
+
+// RedactURL returns rawURL with any user password, credentials and sensitive
+// variable values in the query string replaced. Unparsable URLs are redacted entirely.
+func RedactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return redacted
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = RedactValues(u.Query()).Encode()
+	}
+	return u.String()
+}
+
+// RedactPathAfter returns rawURL redacted like RedactURL, with the path segment following
+// each segment called one of names replaced too, e.g. the secret key of /api/snapshots/{key}
+func RedactPathAfter(rawURL string, names ...string) string {
+	redactedURL := RedactURL(rawURL)
+	if len(names) == 0 || redactedURL == redacted {
+		return redactedURL
+	}
+	u, _ := url.Parse(redactedURL)
+	segments := strings.Split(u.Path, "/")
+	for i := 1; i < len(segments); i++ {
+		for _, name := range names {
+			if segments[i-1] == name {
+				segments[i] = redacted
+			}
+		}
+	}
+	u.Path = strings.Join(segments, "/")
+	u.RawPath = ""
+	return u.String()
+}
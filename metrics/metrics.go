@@ -0,0 +1,148 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package metrics holds the Prometheus metrics of the service, registered with the default registry
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "grafpng"
+
+// reportBuckets spans the durations of reports, from cached reports to large dashboards taking minutes
+var reportBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+var (
+	// Requests counts the requests served, by route template and status code
+	Requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Requests served, by route and status code.",
+	}, []string{"route", "code"})
+
+	// RequestDuration observes the time taken to serve requests, e.g. to generate reports, by route template
+	RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time taken to serve requests, by route.",
+		Buckets:   reportBuckets,
+	}, []string{"route"})
+
+	// PanelDuration observes the time taken to render and decode each panel of a report, by result: ok or error
+	PanelDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "panel_render_duration_seconds",
+		Help:      "Time taken to render a report panel, including waiting for a render slot, by result.",
+		Buckets:   reportBuckets,
+	}, []string{"result"})
+
+	// GrafanaResponses counts the responses of the Grafana api, by operation and status code.
+	// Requests failing without a response are counted with the code error.
+	GrafanaResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "grafana_responses_total",
+		Help:      "Responses of the Grafana api, by operation and status code.",
+	}, []string{"operation", "code"})
+
+	// GrafanaRetries counts the panel renders retried after an error
+	GrafanaRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "grafana_render_retries_total",
+		Help:      "Panel renders retried after Grafana answered with an error.",
+	})
+
+	// CacheLookups counts the lookups of the render cache, by kind (panel or report) and result (hit, miss or bypass)
+	CacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_lookups_total",
+		Help:      "Lookups of the render cache, by kind and result.",
+	}, []string{"kind", "result"})
+
+	// TempDirsRemoved counts the orphaned temporary report directories and job results removed by the sweeper
+	TempDirsRemoved = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "temp_dirs_removed_total",
+		Help:      "Orphaned temporary report directories and job results removed.",
+	})
+
+	// OutputBytes counts the bytes of the responses sent, e.g. report images, by route template
+	OutputBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_response_bytes_total",
+		Help:      "Bytes of the responses sent, by route.",
+	}, []string{"route"})
+)
+
+// ObservePanel records the render of a panel taking d, failed if err is set
+func ObservePanel(d time.Duration, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	PanelDuration.WithLabelValues(result).Observe(d.Seconds())
+}
+
+// ObserveGrafana records a response of the Grafana api to op, or the error of a request without response
+func ObserveGrafana(op string, resp *http.Response, err error) {
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	GrafanaResponses.WithLabelValues(op, code).Inc()
+}
+
+// Middleware counts and times the requests served by a mux router, labelled with their route template
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		route := "unknown"
+		if r := mux.CurrentRoute(req); r != nil {
+			if t, err := r.GetPathTemplate(); err == nil {
+				route = t
+			}
+		}
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(rec, req)
+		RequestDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+		Requests.WithLabelValues(route, strconv.Itoa(rec.code)).Inc()
+		OutputBytes.WithLabelValues(route).Add(float64(rec.bytes))
+	})
+}
+
+// statusRecorder remembers the status code and counts the bytes written to the response
+type statusRecorder struct {
+	http.ResponseWriter
+	code  int
+	bytes int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
@@ -0,0 +1,73 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMiddleware(t *testing.T) {
+	Convey("When requests are served through the metrics middleware", t, func() {
+		router := mux.NewRouter()
+		router.HandleFunc("/api/v5/report/{dashId}", func(w http.ResponseWriter, r *http.Request) {
+			if mux.Vars(r)["dashId"] == "missing" {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			w.Write([]byte("png"))
+		})
+		router.Use(Middleware)
+		route := "/api/v5/report/{dashId}"
+		ok := testutil.ToFloat64(Requests.WithLabelValues(route, "200"))
+		notFound := testutil.ToFloat64(Requests.WithLabelValues(route, "404"))
+		bytes := testutil.ToFloat64(OutputBytes.WithLabelValues(route))
+
+		for _, dash := range []string{"a", "b", "missing"} {
+			req, _ := http.NewRequest("GET", "/api/v5/report/"+dash, nil)
+			router.ServeHTTP(httptest.NewRecorder(), req)
+		}
+
+		Convey("It should count the requests by route template and status code", func() {
+			So(testutil.ToFloat64(Requests.WithLabelValues(route, "200")), ShouldEqual, ok+2)
+			So(testutil.ToFloat64(Requests.WithLabelValues(route, "404")), ShouldEqual, notFound+1)
+		})
+
+		Convey("It should count the bytes sent", func() {
+			So(testutil.ToFloat64(OutputBytes.WithLabelValues(route)), ShouldEqual, bytes+float64(2*len("png")+len("not found\n")))
+		})
+	})
+}
+
+func TestObserve(t *testing.T) {
+	Convey("When observing Grafana responses", t, func() {
+		before := testutil.ToFloat64(GrafanaResponses.WithLabelValues("getPanelPng", "error"))
+		ObserveGrafana("getPanelPng", nil, errors.New("connection refused"))
+		ObserveGrafana("getPanelPng", &http.Response{StatusCode: 500}, nil)
+
+		Convey("It should count requests without response as errors and responses by status code", func() {
+			So(testutil.ToFloat64(GrafanaResponses.WithLabelValues("getPanelPng", "error")), ShouldEqual, before+1)
+			So(testutil.ToFloat64(GrafanaResponses.WithLabelValues("getPanelPng", "500")), ShouldBeGreaterThan, 0)
+		})
+	})
+}
@@ -0,0 +1,171 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package report
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"grafpng/grafana"
+)
+
+// ErrTooManyDashboards is returned for bulk reports whose search matches more dashboards than its limit
+var ErrTooManyDashboards = errors.New("too many dashboards match the search")
+
+// bulkReport renders every dashboard matched by a search into one image,
+// each dashboard under a caption with its title
+type bulkReport struct {
+	client   grafana.Client
+	query    grafana.SearchQuery
+	time     grafana.TimeRange
+	title    string
+	tmpDir   string
+	worker   int
+	inMemory bool
+}
+
+// NewBulkReport creates a Report covering every dashboard matched by the search q, e.g. all dashboards
+// with a tag or inside a folder. If q has a limit, generating fails if more dashboards match.
+// The dashboards are rendered one after the other, each using w workers.
+func NewBulkReport(g grafana.Client, q grafana.SearchQuery, t grafana.TimeRange, w int) Report {
+	q.Type = grafana.SearchTypeDashboard
+	return &bulkReport{
+		client:   g,
+		query:    q,
+		time:     t,
+		tmpDir:   newTempDir(),
+		worker:   w,
+		inMemory: InMemory(),
+	}
+}
+
+// Generate returns the png file. After reading this file it should be Closed()
+// After closing the file, call report.Clean() to delete the file as well the temporary build files
+func (rep *bulkReport) Generate(ctx context.Context) (f io.ReadCloser, err error) {
+	img, err := rep.render(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return openImage(img, rep.inMemory, filepath.Join(rep.tmpDir, outputFile))
+}
+
+// Stream encodes the png straight to w. Call report.Clean() afterwards to delete the temporary build files.
+func (rep *bulkReport) Stream(ctx context.Context, w io.Writer) error {
+	img, err := rep.render(ctx)
+	if err != nil {
+		return err
+	}
+	return png.Encode(w, img)
+}
+
+// render combines the images of all matched dashboards into one image
+func (rep *bulkReport) render(ctx context.Context) (*image.RGBA, error) {
+	// one more dashboard than the limit is searched for, to tell whether the search matches more
+	q := rep.query
+	if q.Limit > 0 {
+		q.Limit++
+	}
+	results, err := rep.client.SearchDashboards(ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("error searching dashboards: %v", err)
+	}
+	if rep.query.Limit > 0 && len(results) > rep.query.Limit {
+		return nil, fmt.Errorf("%w: more than %d, narrow the search or raise its limit", ErrTooManyDashboards, rep.query.Limit)
+	}
+	if len(results) == 0 {
+		return nil, errors.New("no dashboards match the search")
+	}
+	rep.title = bulkTitle(rep.query, results)
+	slog.InfoContext(ctx, "generating bulk report", "title", rep.title, "dashboards", len(results))
+
+	// each dashboard is rendered by its own section of the report
+	base := &report{client: rep.client, time: rep.time, tmpDir: rep.tmpDir, worker: rep.worker, inMemory: rep.inMemory}
+	captions := make([]caption, len(results))
+	sections := make([][]*imageData, len(results))
+	for i, r := range results {
+		dash, err := rep.client.GetDashboard(ctx, r.DashName)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching dashboard %v: %v", r.DashName, err)
+		}
+		sections[i], err = base.section(r.DashName, i).renderPanels(ctx, dash)
+		if err != nil {
+			return nil, fmt.Errorf("error rendering PNGs for dash %v: %w", dash.Title, err)
+		}
+		captions[i] = dashboardCaption(dash, r)
+	}
+
+	img, err := processSections(captions, sections)
+	if err != nil {
+		return nil, fmt.Errorf("error combining dashboards: %v", err)
+	}
+	return img, nil
+}
+
+// Title returns a title describing the search, e.g. the tags or the folder of the dashboards
+func (rep *bulkReport) Title() string {
+	if rep.title == "" {
+		return bulkTitle(rep.query, nil)
+	}
+	return rep.title
+}
+
+// Clean deletes the temporary directory used during report generation
+func (rep *bulkReport) Clean() {
+	err := os.RemoveAll(rep.tmpDir)
+	if err != nil {
+		slog.Error("error cleaning up tmp dir", "dir", rep.tmpDir, "error", err)
+	}
+}
+
+// defaultCaptionWidth is used when none of the dashboards has panels to take the width from
+const defaultCaptionWidth = 800
+
+func bulkTitle(q grafana.SearchQuery, results []grafana.SearchResult) string {
+	switch {
+	case len(q.Tags) > 0:
+		return strings.Join(q.Tags, "_")
+	case len(q.FolderUIDs) > 0 && len(results) > 0 && results[0].FolderTitle != "":
+		return results[0].FolderTitle
+	case len(q.FolderUIDs) > 0:
+		return strings.Join(q.FolderUIDs, "_")
+	case q.Query != "":
+		return q.Query
+	}
+	return "dashboards"
+}
+
+func dashboardCaption(dash grafana.Dashboard, r grafana.SearchResult) caption {
+	c := caption{title: dash.Title}
+	if r.FolderTitle != "" {
+		c.lines = append(c.lines, "Folder: "+r.FolderTitle)
+	}
+	if len(r.Tags) > 0 {
+		c.lines = append(c.lines, "Tags: "+strings.Join(r.Tags, ", "))
+	}
+	for _, v := range dash.VisibleVariables() {
+		c.lines = append(c.lines, variableLine(v))
+	}
+	return c
+}
@@ -0,0 +1,141 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package report
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"grafpng/grafana"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// pngPanel returns a valid png image of the given size
+func pngPanel(width, height int) io.ReadCloser {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height)))
+	return ioutil.NopCloser(&buf)
+}
+
+type bulkClient struct {
+	sync.Mutex
+	query      grafana.SearchQuery
+	dashboards []string
+	panelDash  map[string]int
+}
+
+func (b *bulkClient) GetDashboard(ctx context.Context, dashName string) (grafana.Dashboard, error) {
+	b.Lock()
+	defer b.Unlock()
+	b.dashboards = append(b.dashboards, dashName)
+	return grafana.NewDashboard([]byte(`{"Dashboard":{"Title":"`+dashName+`","Panels":[{"Type":"graph","Id":1},{"Type":"graph","Id":2}]}}`), nil), nil
+}
+
+func (b *bulkClient) GetPanelPng(ctx context.Context, p grafana.Panel, dashName string, t grafana.TimeRange) (io.ReadCloser, error) {
+	b.Lock()
+	defer b.Unlock()
+	b.panelDash[dashName]++
+	return pngPanel(40, 20), nil
+}
+
+func (b *bulkClient) SearchDashboards(ctx context.Context, q grafana.SearchQuery) ([]grafana.SearchResult, error) {
+	b.query = q
+	return []grafana.SearchResult{
+		{UID: "a", Title: "A", Type: grafana.SearchTypeDashboard, DashName: "a", FolderTitle: "Ops"},
+		{UID: "b", Title: "B", Type: grafana.SearchTypeDashboard, DashName: "b", FolderTitle: "Ops"},
+	}, nil
+}
+
+func TestBulkReport(t *testing.T) {
+	Convey("When generating a report for all dashboards with a tag", t, func() {
+		gClient := &bulkClient{panelDash: map[string]int{}}
+		rep := NewBulkReport(gClient, grafana.SearchQuery{Tags: []string{"sla"}}, grafana.TimeRange{From: "now-1h", To: "now"}, 2)
+		defer rep.Clean()
+
+		f, err := rep.Generate(context.Background())
+		So(err, ShouldBeNil)
+		defer f.Close()
+
+		Convey("It should only search for dashboards", func() {
+			So(gClient.query.Tags, ShouldResemble, []string{"sla"})
+			So(gClient.query.Type, ShouldEqual, grafana.SearchTypeDashboard)
+		})
+
+		Convey("It should render every panel of every matching dashboard", func() {
+			So(gClient.dashboards, ShouldResemble, []string{"a", "b"})
+			So(gClient.panelDash, ShouldResemble, map[string]int{"a": 2, "b": 2})
+		})
+
+		Convey("It should keep the panel images of each dashboard apart", func() {
+			files, _ := filepath.Glob(filepath.Join(rep.(*bulkReport).tmpDir, "*", imgDir, "*.png"))
+			So(files, ShouldHaveLength, 4)
+		})
+
+		Convey("It should stack all panels under a caption per dashboard", func() {
+			img, err := png.Decode(f)
+			So(err, ShouldBeNil)
+			captionHeight := caption{title: "A", lines: []string{"Folder: Ops"}}.image(40).height
+			So(img.Bounds().Dx(), ShouldEqual, 40)
+			So(img.Bounds().Dy(), ShouldEqual, 2*captionHeight+4*20)
+		})
+
+		Convey("It should be titled after the tag", func() {
+			So(rep.Title(), ShouldEqual, "sla")
+		})
+	})
+}
+
+func TestBulkReportLimit(t *testing.T) {
+	Convey("When more dashboards match than the limit of the search", t, func() {
+		gClient := &bulkClient{panelDash: map[string]int{}}
+		rep := NewBulkReport(gClient, grafana.SearchQuery{Tags: []string{"sla"}, Limit: 1}, grafana.TimeRange{From: "now-1h", To: "now"}, 2)
+		defer rep.Clean()
+		_, err := rep.Generate(context.Background())
+
+		Convey("It should fail without rendering any dashboard", func() {
+			So(errors.Is(err, ErrTooManyDashboards), ShouldBeTrue)
+			So(gClient.query.Limit, ShouldEqual, 2)
+			So(gClient.dashboards, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestCaption(t *testing.T) {
+	Convey("When rendering a caption", t, func() {
+		c := caption{title: "A dashboard title much too long to fit into the image", lines: []string{"one", "two"}}
+		imd := c.image(200)
+
+		Convey("It should span the requested width", func() {
+			So(imd.width, ShouldEqual, 200)
+			So(imd.img.Bounds().Dx(), ShouldEqual, 200)
+		})
+
+		Convey("It should grow with the number of lines", func() {
+			So(imd.height, ShouldBeGreaterThan, caption{title: "A"}.image(200).height)
+			So(imd.img.Bounds().Dy(), ShouldEqual, imd.height)
+		})
+	})
+}
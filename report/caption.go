@@ -0,0 +1,128 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package report
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+
+	"grafpng/grafana"
+
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	captionMargin     = 10
+	captionTitleScale = 2
+)
+
+var (
+	captionBackground = color.White
+	captionForeground = color.RGBA{0x33, 0x33, 0x33, 0xff}
+)
+
+// caption is a block of text drawn above a group of panels, e.g. the dashboard title and its details
+type caption struct {
+	title string
+	lines []string
+}
+
+// image renders the caption as an image of the given width. The title is drawn
+// at twice the size of the detail lines. Text wider than the image is truncated.
+func (c caption) image(width int) *imageData {
+	face := basicfont.Face7x13
+	lineHeight := face.Metrics().Height.Ceil()
+	height := captionMargin + lineHeight*captionTitleScale + len(c.lines)*lineHeight + captionMargin
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(captionBackground), image.Point{}, draw.Src)
+
+	// the title is drawn at 1x and scaled up, as the built in font only comes in one size
+	titleWidth := (width - 2*captionMargin) / captionTitleScale
+	if titleWidth > 0 {
+		title := image.NewRGBA(image.Rect(0, 0, titleWidth, lineHeight))
+		draw.Draw(title, title.Bounds(), image.NewUniform(captionBackground), image.Point{}, draw.Src)
+		drawText(title, face, c.title, 0, 0)
+		dst := image.Rect(captionMargin, captionMargin, captionMargin+titleWidth*captionTitleScale, captionMargin+lineHeight*captionTitleScale)
+		xdraw.NearestNeighbor.Scale(img, dst, title, title.Bounds(), draw.Over, nil)
+	}
+
+	y := captionMargin + lineHeight*captionTitleScale
+	for _, l := range c.lines {
+		drawText(img, face, l, captionMargin, y)
+		y += lineHeight
+	}
+	return &imageData{img: img, width: width, height: height}
+}
+
+// drawText draws s with its top left corner at x, y, truncating it at the right edge of dst
+func drawText(dst draw.Image, face font.Face, s string, x, y int) {
+	d := &font.Drawer{
+		Dst:  dst,
+		Src:  image.NewUniform(captionForeground),
+		Face: face,
+		Dot:  fixed.P(x, y+face.Metrics().Ascent.Ceil()),
+	}
+	maxWidth := fixed.I(dst.Bounds().Dx() - x)
+	if d.MeasureString(s) > maxWidth {
+		r := []rune(s)
+		for len(r) > 0 && d.MeasureString(string(r)+"...") > maxWidth {
+			r = r[:len(r)-1]
+		}
+		s = string(r) + "..."
+	}
+	d.DrawString(s)
+}
+
+// variableLine describes the effective value of a template variable as Grafana shows it:
+// by its label, or by value alone if the label is hidden
+func variableLine(v grafana.Variable) string {
+	if v.Hide == grafana.HideLabel {
+		return v.DisplayText()
+	}
+	return v.DisplayName() + ": " + v.DisplayText()
+}
+
+// versionCaption labels a report on a historical dashboard revision with its version and author
+func versionCaption(dash grafana.Dashboard) caption {
+	v := dash.Version
+	c := caption{title: reportTitle(dash)}
+	c.lines = append(c.lines, fmt.Sprintf("Saved by %s on %s", v.CreatedBy, v.Created))
+	if v.Message != "" {
+		c.lines = append(c.lines, "Message: "+v.Message)
+	}
+	return c
+}
+
+// headerCaption titles a report on a single dashboard, describing its revision if it is not the current one
+// and listing the effective values of its visible template variables. It reports false if there is nothing to describe.
+func headerCaption(dash grafana.Dashboard) (caption, bool) {
+	c := caption{title: reportTitle(dash)}
+	if dash.Version != nil {
+		c = versionCaption(dash)
+	}
+	vars := dash.VisibleVariables()
+	for _, v := range vars {
+		c.lines = append(c.lines, variableLine(v))
+	}
+	return c, dash.Version != nil || len(vars) > 0
+}
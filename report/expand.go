@@ -0,0 +1,108 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package report
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"log/slog"
+
+	"grafpng/grafana"
+)
+
+// renderExpanded renders all panels of dash once per value of the expanded template variable,
+// stacking the renders of each value under a caption naming the value
+func (rep *report) renderExpanded(ctx context.Context, dash grafana.Dashboard) (*image.RGBA, error) {
+	name := rep.opts.ExpandVariable
+	values, err := dash.ExpandValues(name, rep.opts.ExpandValues)
+	if err != nil {
+		return nil, err
+	}
+	slog.InfoContext(ctx, "expanding template variable", "variable", name, "values", len(values))
+
+	captions := make([]caption, len(values))
+	sections := make([][]*imageData, len(values))
+	for i, value := range values {
+		sections[i], err = rep.section(rep.dashName, i).renderPanels(ctx, scopedDashboard(dash, name, value))
+		if err != nil {
+			return nil, fmt.Errorf("error rendering %v=%v: %w", name, value, err)
+		}
+		captions[i] = expandedCaption(dash, name, value)
+	}
+	if dash.Version != nil {
+		captions = append([]caption{versionCaption(dash)}, captions...)
+		sections = append([][]*imageData{nil}, sections...)
+	}
+	return processSections(captions, sections)
+}
+
+// scopedDashboard returns dash with all panels rendered with the template variable name set to value.
+// Rows repeated for the variable are rendered once, without a header, as the section caption names the value.
+func scopedDashboard(dash grafana.Dashboard, name, value string) grafana.Dashboard {
+	if len(dash.Rows) == 0 {
+		dash.Panels = withScopedVar(dash.Panels, name, value)
+		return dash
+	}
+	var rows []grafana.Row
+	var panels []grafana.Panel
+	for _, row := range dash.Rows {
+		if row.Repeat == name {
+			if row.RepeatIndex > 0 {
+				continue
+			}
+			row.ScopedVars = nil
+		}
+		row.Panels = withScopedVar(row.Panels, name, value)
+		rows = append(rows, row)
+		panels = append(panels, row.Panels...)
+	}
+	dash.Rows, dash.Panels = rows, panels
+	return dash
+}
+
+// withScopedVar returns copies of panels rendered with the template variable name set to value.
+// Panels repeated for the variable are rendered once, as there is a single value to repeat them for.
+func withScopedVar(panels []grafana.Panel, name, value string) []grafana.Panel {
+	var scoped []grafana.Panel
+	for _, p := range panels {
+		if p.Repeat == name {
+			if p.RepeatIndex > 0 {
+				continue
+			}
+			p.Repeat, p.RenderWidth = "", 0
+		}
+		scoped = append(scoped, p.WithScopedVar(name, value))
+	}
+	return scoped
+}
+
+// expandedCaption names the value of the expanded variable a section is rendered with,
+// listing the effective values of the other template variables below it
+func expandedCaption(dash grafana.Dashboard, name, value string) caption {
+	v, ok := dash.Variable(name)
+	if !ok {
+		return caption{title: fmt.Sprintf("%s: %s", name, value)}
+	}
+	c := caption{title: fmt.Sprintf("%s: %s", v.DisplayName(), v.OptionText(value))}
+	for _, other := range dash.VisibleVariables() {
+		if other.Name != v.Name {
+			c.lines = append(c.lines, variableLine(other))
+		}
+	}
+	return c
+}
@@ -0,0 +1,162 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package report
+
+import (
+	"context"
+	"image/png"
+	"io"
+	"sort"
+	"sync"
+	"testing"
+
+	"grafpng/grafana"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const hostsDashJSON = `
+{"Dashboard":
+	{
+		"Title":"Hosts",
+		"Panels":[{"Type":"graph", "Id":1}, {"Type":"singlestat", "Id":2}],
+		"templating": {"list": [
+			{"name": "host", "options": [
+				{"text": "All", "value": "$__all"},
+				{"text": "web1", "value": "web1"},
+				{"text": "web2", "value": "web2"},
+				{"text": "web3", "value": "web3"}
+			]}
+		]}
+	}
+}`
+
+// scopedClient records the host each panel was rendered for
+type scopedClient struct {
+	sync.Mutex
+	hosts []string
+}
+
+func (c *scopedClient) GetDashboard(ctx context.Context, dashName string) (grafana.Dashboard, error) {
+	return grafana.NewDashboard([]byte(hostsDashJSON), nil), nil
+}
+
+func (c *scopedClient) GetPanelPng(ctx context.Context, p grafana.Panel, dashName string, t grafana.TimeRange) (io.ReadCloser, error) {
+	c.Lock()
+	defer c.Unlock()
+	c.hosts = append(c.hosts, p.ScopedVars.Get("var-host"))
+	return pngPanel(30, 10), nil
+}
+
+func (c *scopedClient) SearchDashboards(ctx context.Context, q grafana.SearchQuery) ([]grafana.SearchResult, error) {
+	return nil, nil
+}
+
+func TestExpandedReport(t *testing.T) {
+	Convey("When generating a report expanding a template variable", t, func() {
+		gClient := &scopedClient{}
+		opts := Options{ExpandVariable: "host", ExpandValues: []string{grafana.AllValue}}
+		rep := NewReport(gClient, "hosts", grafana.TimeRange{From: "now-1h", To: "now"}, 2, opts)
+		defer rep.Clean()
+
+		f, err := rep.Generate(context.Background())
+		So(err, ShouldBeNil)
+		defer f.Close()
+
+		Convey("It should render every panel once per value of the variable", func() {
+			sort.Strings(gClient.hosts)
+			So(gClient.hosts, ShouldResemble, []string{"web1", "web1", "web2", "web2", "web3", "web3"})
+		})
+
+		Convey("It should stack one captioned section per value", func() {
+			img, err := png.Decode(f)
+			So(err, ShouldBeNil)
+			captionHeight := caption{title: "host: web1"}.image(30).height
+			So(img.Bounds().Dy(), ShouldEqual, 3*captionHeight+6*10)
+		})
+	})
+
+	Convey("When expanding explicitly requested values", t, func() {
+		gClient := &scopedClient{}
+		opts := Options{ExpandVariable: "host", ExpandValues: []string{"db1"}}
+		rep := NewReport(gClient, "hosts", grafana.TimeRange{From: "now-1h", To: "now"}, 2, opts)
+		defer rep.Clean()
+		f, err := rep.Generate(context.Background())
+		So(err, ShouldBeNil)
+		f.Close()
+
+		Convey("Only the requested values should be rendered", func() {
+			So(gClient.hosts, ShouldResemble, []string{"db1", "db1"})
+		})
+	})
+}
+
+func TestVariableCaptions(t *testing.T) {
+	Convey("When describing template variables in captions", t, func() {
+		dash := grafana.NewDashboard([]byte(`{"Dashboard": {"Title": "Hosts", "templating": {"list": [
+			{"name": "host", "label": "Host", "options": [{"text": "web one", "value": "web1"}]},
+			{"name": "env", "label": "Environment", "current": {"text": "Production", "value": "prod"},
+				"options": [{"text": "Production", "value": "prod"}]},
+			{"name": "dc", "hide": 1, "current": {"text": "eu", "value": "eu"}},
+			{"name": "token", "hide": 2, "current": {"text": "t", "value": "t"}}
+		]}}}`), nil)
+
+		Convey("The expanded variable should be named by its label and option text", func() {
+			c := expandedCaption(dash, "host", "web1")
+			So(c.title, ShouldEqual, "Host: web one")
+		})
+
+		Convey("Other visible variables should be listed with their effective values", func() {
+			c := expandedCaption(dash, "host", "web1")
+			So(c.lines, ShouldResemble, []string{"Environment: Production", "eu"})
+		})
+
+		Convey("Plain report captions should list the visible variables under the dashboard title", func() {
+			c, ok := headerCaption(dash)
+			So(ok, ShouldBeTrue)
+			So(c.title, ShouldEqual, "Hosts")
+			So(c.lines, ShouldResemble, []string{"Environment: Production", "eu"})
+		})
+
+		Convey("Plain reports on dashboards without visible variables should have no caption", func() {
+			_, ok := headerCaption(grafana.Dashboard{Title: "Hosts"})
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Bulk dashboard captions should list the variables too", func() {
+			c := dashboardCaption(dash, grafana.SearchResult{FolderTitle: "Ops"})
+			So(c.lines, ShouldResemble, []string{"Folder: Ops", "Environment: Production", "eu"})
+		})
+	})
+}
+
+func TestVersionCaption(t *testing.T) {
+	Convey("When reporting on a dashboard revision", t, func() {
+		dash := grafana.Dashboard{Title: "Ops", Version: &grafana.DashboardVersion{Version: 3, CreatedBy: "alice", Created: "2024-05-01T10:00:00Z", Message: "move panels"}}
+
+		Convey("The report title should name the version", func() {
+			So(reportTitle(dash), ShouldEqual, "Ops (version 3)")
+			So(reportTitle(grafana.Dashboard{Title: "Ops"}), ShouldEqual, "Ops")
+		})
+
+		Convey("The caption should name the author and message", func() {
+			c := versionCaption(dash)
+			So(c.title, ShouldEqual, "Ops (version 3)")
+			So(c.lines, ShouldResemble, []string{"Saved by alice on 2024-05-01T10:00:00Z", "Message: move panels"})
+		})
+	})
+}
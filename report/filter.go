@@ -0,0 +1,124 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package report
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"grafpng/grafana"
+)
+
+// ErrNoPanelsMatch is returned for reports whose panel filters leave no panel of the dashboard to render
+var ErrNoPanelsMatch = errors.New("no panels match the panel filters")
+
+// PanelFilter selects panels by id, title, type or the title of the row they are in.
+// Criteria left empty match every panel.
+type PanelFilter struct {
+	IDs   []int
+	Title *regexp.Regexp
+	Types []string
+	Rows  []string
+}
+
+// IsEmpty reports whether no criteria are set
+func (f PanelFilter) IsEmpty() bool {
+	return len(f.IDs) == 0 && f.Title == nil && len(f.Types) == 0 && len(f.Rows) == 0
+}
+
+// matches returns whether p in the row titled row matches each of the criteria set, in order:
+// id, title, type and row
+func (f PanelFilter) matches(p grafana.Panel, row string) []bool {
+	var m []bool
+	if len(f.IDs) > 0 {
+		found := false
+		for _, id := range f.IDs {
+			found = found || id == p.ID
+		}
+		m = append(m, found)
+	}
+	if f.Title != nil {
+		m = append(m, f.Title.MatchString(p.Title))
+	}
+	if len(f.Types) > 0 {
+		m = append(m, containsFold(f.Types, p.Type))
+	}
+	if len(f.Rows) > 0 {
+		m = append(m, containsFold(f.Rows, row))
+	}
+	return m
+}
+
+func containsFold(list []string, s string) bool {
+	for _, l := range list {
+		if strings.EqualFold(l, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// included reports whether a panel is kept in the report: it must match all criteria of
+// the Include filter and none of the criteria of the Exclude filter
+func (o Options) included(p grafana.Panel, row string) bool {
+	for _, m := range o.Include.matches(p, row) {
+		if !m {
+			return false
+		}
+	}
+	for _, m := range o.Exclude.matches(p, row) {
+		if m {
+			return false
+		}
+	}
+	return true
+}
+
+// filterDashboard removes the panels not selected by the panel filters from dash.
+// Rows left without panels are removed too.
+func (o Options) filterDashboard(dash grafana.Dashboard) grafana.Dashboard {
+	if o.Include.IsEmpty() && o.Exclude.IsEmpty() {
+		return dash
+	}
+	if len(dash.Rows) == 0 {
+		dash.Panels = o.filterPanels(dash.Panels, "")
+		return dash
+	}
+	var rows []grafana.Row
+	var panels []grafana.Panel
+	for _, row := range dash.Rows {
+		row.Panels = o.filterPanels(row.Panels, row.Title)
+		if len(row.Panels) == 0 {
+			continue
+		}
+		rows = append(rows, row)
+		panels = append(panels, row.Panels...)
+	}
+	dash.Rows, dash.Panels = rows, panels
+	return dash
+}
+
+func (o Options) filterPanels(panels []grafana.Panel, row string) []grafana.Panel {
+	var filtered []grafana.Panel
+	for _, p := range panels {
+		if o.included(p, row) {
+			filtered = append(filtered, p)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,87 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package report
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+
+	"grafpng/grafana"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const filterDashJSON = `
+{"Dashboard":
+	{
+		"Title":"Filters",
+		"Panels":[
+			{"Type":"text", "Id":1, "Title": "Notes"},
+			{"Type":"row", "Id":2, "title": "Load"},
+			{"Type":"graph", "Id":3, "Title": "CPU load"},
+			{"Type":"graph", "Id":4, "Title": "Memory"},
+			{"Type":"row", "Id":5, "title": "Debug"},
+			{"Type":"table", "Id":6, "Title": "CPU raw"}
+		]
+	}
+}`
+
+func panelIDs(dash grafana.Dashboard) []int {
+	var ids []int
+	for _, p := range dash.Panels {
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
+
+func TestPanelFilters(t *testing.T) {
+	Convey("When filtering the panels of a dashboard", t, func() {
+		dash := grafana.NewDashboard([]byte(filterDashJSON), nil)
+
+		Convey("No filters should keep every panel", func() {
+			So(panelIDs(Options{}.filterDashboard(dash)), ShouldResemble, []int{1, 3, 4, 6})
+		})
+
+		Convey("Included panels should match all criteria", func() {
+			opts := Options{Include: PanelFilter{Title: regexp.MustCompile("^CPU"), Types: []string{"Graph"}}}
+			So(panelIDs(opts.filterDashboard(dash)), ShouldResemble, []int{3})
+		})
+
+		Convey("Included panels should be selected by id", func() {
+			opts := Options{Include: PanelFilter{IDs: []int{6, 1}}}
+			So(panelIDs(opts.filterDashboard(dash)), ShouldResemble, []int{1, 6})
+		})
+
+		Convey("Panels matching any exclusion criterion should be removed", func() {
+			opts := Options{Exclude: PanelFilter{Types: []string{"text"}, Rows: []string{"debug"}}}
+			filtered := opts.filterDashboard(dash)
+			So(panelIDs(filtered), ShouldResemble, []int{3, 4})
+			So(filtered.Rows, ShouldHaveLength, 1)
+			So(filtered.Rows[0].Title, ShouldEqual, "Load")
+		})
+
+		Convey("Generating a report without any panel left should fail", func() {
+			opts := Options{Include: PanelFilter{IDs: []int{42}}}
+			rep := NewReport(repeatClient{filterDashJSON}, "filters", grafana.TimeRange{From: "now-1h", To: "now"}, 1, opts)
+			defer rep.Clean()
+			_, err := rep.Generate(context.Background())
+			So(errors.Is(err, ErrNoPanelsMatch), ShouldBeTrue)
+		})
+	})
+}
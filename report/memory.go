@@ -0,0 +1,65 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package report
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"log/slog"
+	"sync/atomic"
+
+	"grafpng/grafana"
+)
+
+// Streamer is implemented by reports that can encode their image straight to a writer,
+// e.g. a http.ResponseWriter, instead of returning it from Generate
+type Streamer interface {
+	Stream(ctx context.Context, w io.Writer) error
+}
+
+// inMemory selects the in-memory pipeline for reports created from now on
+var inMemory atomic.Bool
+
+// SetInMemory makes reports decode panels straight from the Grafana responses and encode
+// their image in memory, instead of copying every panel and the image to temporary files
+func SetInMemory(on bool) {
+	inMemory.Store(on)
+}
+
+// InMemory reports whether reports are generated in memory
+func InMemory() bool {
+	return inMemory.Load()
+}
+
+// decodePanel renders p and decodes it straight from the response, taking its dimensions from the decoded image
+func (rep *report) decodePanel(ctx context.Context, p grafana.Panel) (*imageData, error) {
+	body, err := rep.client.GetPanelPng(ctx, p, rep.dashName, rep.time)
+	if err != nil {
+		slog.ErrorContext(ctx, "error creating image for panel", "panel", p.ID, "error", err)
+		return nil, fmt.Errorf("error getting panel %d %q: %w", p.ID, p.Title, err)
+	}
+	defer body.Close()
+	img, _, err := image.Decode(body)
+	if err != nil {
+		slog.ErrorContext(ctx, "unable to decode image", "panel", p.ID, "error", err)
+		return nil, fmt.Errorf("error decoding panel %d %q: %v", p.ID, p.Title, err)
+	}
+	b := img.Bounds()
+	return &imageData{img: img, width: b.Dx(), height: b.Dy()}, nil
+}
@@ -0,0 +1,150 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package report
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"testing"
+
+	"grafpng/grafana"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// generateImage generates rep and decodes its image
+func generateImage(rep Report) (image.Image, error) {
+	f, err := rep.Generate(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	return img, err
+}
+
+func TestInMemoryReport(t *testing.T) {
+	Convey("When reports are generated in memory", t, func() {
+		defer SetInMemory(false)
+		tr := grafana.TimeRange{From: "now-1h", To: "now"}
+		onDisk := NewReport(repeatClient{repeatDashJSON}, "repeats", tr, 3, Options{})
+		defer onDisk.Clean()
+		want, err := generateImage(onDisk)
+		So(err, ShouldBeNil)
+
+		SetInMemory(true)
+		rep := NewReport(repeatClient{repeatDashJSON}, "repeats", tr, 3, Options{})
+		defer rep.Clean()
+
+		Convey("Generate should return the same image without writing temporary files", func() {
+			img, err := generateImage(rep)
+			So(err, ShouldBeNil)
+			So(img.Bounds(), ShouldResemble, want.Bounds())
+			_, err = os.Stat(rep.(*report).tmpDir)
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("Stream should encode the image to the writer", func() {
+			var buf bytes.Buffer
+			So(rep.(Streamer).Stream(context.Background(), &buf), ShouldBeNil)
+			img, err := png.Decode(&buf)
+			So(err, ShouldBeNil)
+			So(img.Bounds(), ShouldResemble, want.Bounds())
+			_, err = os.Stat(rep.(*report).tmpDir)
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("Bulk reports should be streamed without writing temporary files", func() {
+			bulk := NewBulkReport(&bulkClient{panelDash: make(map[string]int)}, grafana.SearchQuery{Tags: []string{"ops"}}, tr, 2)
+			defer bulk.Clean()
+			var buf bytes.Buffer
+			So(bulk.(Streamer).Stream(context.Background(), &buf), ShouldBeNil)
+			_, err := png.Decode(&buf)
+			So(err, ShouldBeNil)
+			_, err = os.Stat(bulk.(*bulkReport).tmpDir)
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("Undecodable panels should fail the report", func() {
+			rep := NewReport(&mockGrafanaClient{}, "testDash", tr, 3, Options{})
+			defer rep.Clean()
+			_, err := rep.Generate(context.Background())
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+// benchClient renders every panel of dashJSON as the same png
+type benchClient struct {
+	png []byte
+}
+
+func (c benchClient) GetDashboard(ctx context.Context, dashName string) (grafana.Dashboard, error) {
+	return grafana.NewDashboard([]byte(dashJSON), nil), nil
+}
+
+func (c benchClient) GetPanelPng(ctx context.Context, p grafana.Panel, dashName string, t grafana.TimeRange) (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(c.png)), nil
+}
+
+func (c benchClient) SearchDashboards(ctx context.Context, q grafana.SearchQuery) ([]grafana.SearchResult, error) {
+	return nil, nil
+}
+
+func newBenchClient(b *testing.B) benchClient {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 1000, 500))); err != nil {
+		b.Fatal(err)
+	}
+	return benchClient{buf.Bytes()}
+}
+
+// BenchmarkReportOnDisk copies every panel to a file, decodes it and writes the report to a file before reading it back
+func BenchmarkReportOnDisk(b *testing.B) {
+	c := newBenchClient(b)
+	SetInMemory(false)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		rep := NewReport(c, "bench", grafana.TimeRange{From: "now-1h", To: "now"}, 4, Options{})
+		f, err := rep.Generate(context.Background())
+		if err != nil {
+			b.Fatal(err)
+		}
+		io.Copy(io.Discard, f)
+		f.Close()
+		rep.Clean()
+	}
+}
+
+// BenchmarkReportInMemory decodes every panel from its response and encodes the report straight to the writer
+func BenchmarkReportInMemory(b *testing.B) {
+	c := newBenchClient(b)
+	SetInMemory(true)
+	defer SetInMemory(false)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		rep := NewReport(c, "bench", grafana.TimeRange{From: "now-1h", To: "now"}, 4, Options{})
+		if err := rep.(Streamer).Stream(context.Background(), io.Discard); err != nil {
+			b.Fatal(err)
+		}
+		rep.Clean()
+	}
+}
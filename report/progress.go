@@ -0,0 +1,74 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package report
+
+import (
+	"fmt"
+	"sync"
+
+	"grafpng/grafana"
+)
+
+// Progress counts the panels rendered by a report, e.g. to follow a report generated in the background.
+// It is safe for concurrent use. A nil Progress counts nothing.
+type Progress struct {
+	mu     sync.Mutex
+	status ProgressStatus
+}
+
+// ProgressStatus is a snapshot of a Progress. Total grows as the sections of a report are rendered.
+type ProgressStatus struct {
+	Total  int      `json:"total"`
+	Done   int      `json:"done"`
+	Failed int      `json:"failed"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+// Status returns the current counts
+func (p *Progress) Status() ProgressStatus {
+	if p == nil {
+		return ProgressStatus{}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.status
+	s.Errors = append([]string(nil), p.status.Errors...)
+	return s
+}
+
+func (p *Progress) add(panels int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status.Total += panels
+}
+
+func (p *Progress) panelDone(panel grafana.Panel, err error) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.status.Failed++
+		p.status.Errors = append(p.status.Errors, fmt.Sprintf("panel %d: %v", panel.ID, err))
+		return
+	}
+	p.status.Done++
+}
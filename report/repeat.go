@@ -0,0 +1,111 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package report
+
+import (
+	"image"
+	"image/draw"
+
+	"grafpng/grafana"
+)
+
+// layoutRows lays out the images of the panels of dash row by row,
+// drawing a header with the row title above each repeated row instance.
+// images holds the image of each of the panels of dash.
+func layoutRows(dash grafana.Dashboard, images []*imageData) []*imageData {
+	if !dash.HasRepeatedRows() || rowPanelCount(dash.Rows) != len(images) {
+		return layoutRepeats(dash.Panels, images)
+	}
+	_, width, _ := getMaxDim(images)
+	if width == 0 {
+		width = defaultCaptionWidth
+	}
+	var laidOut []*imageData
+	start := 0
+	for _, row := range dash.Rows {
+		end := start + len(row.Panels)
+		if row.IsRepeated() {
+			laidOut = append(laidOut, caption{title: row.Title}.image(width))
+		}
+		laidOut = append(laidOut, layoutRepeats(row.Panels, images[start:end])...)
+		start = end
+	}
+	return laidOut
+}
+
+func rowPanelCount(rows []grafana.Row) int {
+	n := 0
+	for _, row := range rows {
+		n += len(row.Panels)
+	}
+	return n
+}
+
+// layoutRepeats joins the images of horizontally repeated panel instances into rows,
+// at most PerRow instances side by side. images holds the image of each of panels.
+func layoutRepeats(panels []grafana.Panel, images []*imageData) []*imageData {
+	var laidOut []*imageData
+	for i := 0; i < len(panels); {
+		p := panels[i]
+		if !p.IsHorizontalRepeat() {
+			laidOut = append(laidOut, images[i])
+			i++
+			continue
+		}
+		n := repeatInstances(panels[i:])
+		perRow := p.PerRow(n)
+		for j := 0; j < n; j += perRow {
+			end := j + perRow
+			if end > n {
+				end = n
+			}
+			laidOut = append(laidOut, joinHorizontal(images[i+j:i+end]))
+		}
+		i += n
+	}
+	return laidOut
+}
+
+// repeatInstances counts the instances of the repeated panel at the start of panels
+func repeatInstances(panels []grafana.Panel) int {
+	n := 1
+	for n < len(panels) && panels[n].ID == panels[0].ID && panels[n].RepeatIndex > 0 {
+		n++
+	}
+	return n
+}
+
+// joinHorizontal draws images side by side into one image
+func joinHorizontal(images []*imageData) *imageData {
+	if len(images) == 1 {
+		return images[0]
+	}
+	width, height := 0, 0
+	for _, imd := range images {
+		width += imd.width
+		if imd.height > height {
+			height = imd.height
+		}
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	x := 0
+	for _, imd := range images {
+		draw.Draw(img, image.Rect(x, 0, x+imd.width, imd.height), imd.img, image.Point{0, 0}, draw.Over)
+		x += imd.width
+	}
+	return &imageData{img: img, width: width, height: height}
+}
@@ -0,0 +1,164 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package report
+
+import (
+	"context"
+	"errors"
+	"image"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"grafpng/grafana"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const repeatDashJSON = `
+{"Dashboard":
+	{
+		"Title":"Repeats",
+		"Panels":[
+			{"Type":"graph", "Id":1, "repeat": "host", "maxPerRow": 2},
+			{"Type":"graph", "Id":2, "repeat": "host", "repeatDirection": "v"}
+		],
+		"templating": {"list": [
+			{"name": "host", "current": {"text": ["web1", "web2", "web3"], "value": ["web1", "web2", "web3"]}}
+		]}
+	}
+}`
+
+const repeatRowDashJSON = `
+{"Dashboard":
+	{
+		"Title":"Repeats",
+		"Panels":[
+			{"Type":"singlestat", "Id":1},
+			{"Type":"row", "Id":2, "title": "Host $host", "repeat": "host"},
+			{"Type":"graph", "Id":3}
+		],
+		"templating": {"list": [
+			{"name": "host", "current": {"text": ["web1", "web2"], "value": ["web1", "web2"]}}
+		]}
+	}
+}`
+
+// repeatClient renders every panel of dashJSON as an image half as wide as requested
+type repeatClient struct {
+	dashJSON string
+}
+
+func (c repeatClient) GetDashboard(ctx context.Context, dashName string) (grafana.Dashboard, error) {
+	return grafana.NewDashboard([]byte(c.dashJSON), nil), nil
+}
+
+func (c repeatClient) GetPanelPng(ctx context.Context, p grafana.Panel, dashName string, t grafana.TimeRange) (io.ReadCloser, error) {
+	width := 800
+	if p.RenderWidth > 0 {
+		width = p.RenderWidth
+	}
+	return pngPanel(width/2, 10), nil
+}
+
+func (c repeatClient) SearchDashboards(ctx context.Context, q grafana.SearchQuery) ([]grafana.SearchResult, error) {
+	return nil, nil
+}
+
+func TestRepeatedPanels(t *testing.T) {
+	Convey("When generating a report with repeated panels", t, func() {
+		rep := NewReport(repeatClient{repeatDashJSON}, "repeats", grafana.TimeRange{From: "now-1h", To: "now"}, 3, Options{})
+		defer rep.Clean()
+
+		f, err := rep.Generate(context.Background())
+		So(err, ShouldBeNil)
+		defer f.Close()
+
+		Convey("Every instance should be rendered to its own file", func() {
+			files, _ := filepath.Glob(filepath.Join(rep.(*report).imgDirPath(), "*.png"))
+			So(files, ShouldHaveLength, 6)
+		})
+
+		Convey("Horizontal instances should be laid out in rows and vertical instances stacked", func() {
+			img, _, err := image.Decode(f)
+			So(err, ShouldBeNil)
+			So(img.Bounds().Dx(), ShouldEqual, 400)
+			variablesHeight := caption{title: "Repeats", lines: []string{"host: web1 + web2 + web3"}}.image(400).height
+			So(img.Bounds().Dy(), ShouldEqual, variablesHeight+2*10+3*10)
+		})
+	})
+}
+
+func TestRepeatedRows(t *testing.T) {
+	Convey("When generating a report with repeated rows", t, func() {
+		rep := NewReport(repeatClient{repeatRowDashJSON}, "repeats", grafana.TimeRange{From: "now-1h", To: "now"}, 3, Options{})
+		defer rep.Clean()
+
+		f, err := rep.Generate(context.Background())
+		So(err, ShouldBeNil)
+		defer f.Close()
+
+		Convey("The panels of every row instance should be rendered to their own files", func() {
+			files, _ := filepath.Glob(filepath.Join(rep.(*report).imgDirPath(), "*.png"))
+			So(files, ShouldHaveLength, 3)
+		})
+
+		Convey("Each row instance should be drawn under its own header", func() {
+			img, _, err := image.Decode(f)
+			So(err, ShouldBeNil)
+			headerHeight := caption{title: "Host web1"}.image(400).height
+			variablesHeight := caption{title: "Repeats", lines: []string{"host: web1 + web2"}}.image(400).height
+			So(img.Bounds().Dy(), ShouldEqual, variablesHeight+3*10+2*headerHeight)
+		})
+
+		Convey("Rows repeated for an expanded variable should be rendered once per section", func() {
+			dash := grafana.NewDashboard([]byte(repeatRowDashJSON), nil)
+			scoped := scopedDashboard(dash, "host", "web2")
+			So(scoped.Rows, ShouldHaveLength, 2)
+			So(scoped.HasRepeatedRows(), ShouldBeFalse)
+			So(scoped.Panels, ShouldHaveLength, 2)
+			So(scoped.Panels[1].ScopedVars.Get("var-host"), ShouldEqual, "web2")
+		})
+	})
+}
+
+// failingRepeatClient fails to render every panel
+type failingRepeatClient struct {
+	repeatClient
+}
+
+func (c failingRepeatClient) GetPanelPng(ctx context.Context, p grafana.Panel, dashName string, t grafana.TimeRange) (io.ReadCloser, error) {
+	return nil, errors.New("renderer unavailable")
+}
+
+func TestPanelErrors(t *testing.T) {
+	Convey("When rendering a repeated panel fails", t, func() {
+		dashJSON := strings.Replace(repeatDashJSON, `"web1", "web2", "web3"], "value": ["web1", "web2", "web3"]`, `"s3cr3t"], "value": ["s3cr3t"]`, 1)
+		for _, memory := range []bool{false, true} {
+			SetInMemory(memory)
+			rep := NewReport(failingRepeatClient{repeatClient{dashJSON}}, "repeats", grafana.TimeRange{From: "now-1h", To: "now"}, 1, Options{})
+			_, err := rep.Generate(context.Background())
+			rep.Clean()
+			SetInMemory(false)
+
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "renderer unavailable")
+			So(err.Error(), ShouldNotContainSubstring, "s3cr3t")
+		}
+	})
+}
@@ -17,29 +17,48 @@
 package report
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"image"
 	"image/draw"
 	"image/png"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"strconv"
 	"sync"
-	"sync/atomic"
+	"time"
 
-	"github.com/JaySeek/grafpng/grafana"
-	"github.com/pborman/uuid"
+	"grafpng/grafana"
+	"grafpng/metrics"
 )
 
 // Report groups functions related to genrating the report.
 type Report interface {
-	Generate() (f io.ReadCloser, err error)
+	Generate(ctx context.Context) (f io.ReadCloser, err error)
 	Title() string
 	Clean()
 }
 
+// Options tune how a report is generated. The zero value renders every panel of the dashboard once.
+type Options struct {
+	// ExpandVariable names a template variable, without the var- prefix, to render one section per value of.
+	// Each section renders all panels with that single value.
+	ExpandVariable string
+	// ExpandValues are the values of ExpandVariable to render. If empty or the All value
+	// is included, every option of the variable stored in the dashboard is rendered.
+	ExpandValues []string
+	// Include and Exclude select the panels rendered. A panel is rendered if it matches
+	// all criteria of Include and none of the criteria of Exclude.
+	Include PanelFilter
+	Exclude PanelFilter
+	// Progress, if set, counts the panels rendered
+	Progress *Progress
+}
+
 type report struct {
 	client    grafana.Client
 	time      grafana.TimeRange
@@ -47,6 +66,8 @@ type report struct {
 	dashTitle string
 	tmpDir    string
 	worker    int
+	opts      Options
+	inMemory  bool
 }
 
 // imageData struct fold holding each input image and related data
@@ -58,57 +79,93 @@ type imageData struct {
 }
 
 const (
-	imgDir = "images"
+	imgDir     = "images"
+	outputFile = "report.png"
 )
 
 // NewReport creates a new Report.
-func NewReport(g grafana.Client, d string, t grafana.TimeRange, w int) Report {
+func NewReport(g grafana.Client, d string, t grafana.TimeRange, w int, opts Options) Report {
 	return &report{
 		client:    g,
 		time:      t,
 		dashName:  d,
 		dashTitle: "",
-		tmpDir:    filepath.Join("tmp", uuid.New()),
+		tmpDir:    newTempDir(),
 		worker:    w,
+		opts:      opts,
+		inMemory:  InMemory(),
 	}
 }
 
 // Generate returns the png file. After reading this file it should be Closed()
 // After closing the file, call report.Clean() to delete the file as well the temporary build files
-func (rep *report) Generate() (f io.ReadCloser, err error) {
-	dash, err := rep.client.GetDashboard(rep.dashName)
+func (rep *report) Generate(ctx context.Context) (f io.ReadCloser, err error) {
+	img, err := rep.render(ctx)
 	if err != nil {
-		err = fmt.Errorf("error fetching dashboard %v: %v", rep.dashName, err)
-		return
+		return nil, err
 	}
-	rep.dashTitle = dash.Title
+	return openImage(img, rep.inMemory, rep.outputPath())
+}
 
-	fn, err := rep.renderPNGsParallel(dash)
+// Stream encodes the png straight to w. Call report.Clean() afterwards to delete the temporary build files.
+func (rep *report) Stream(ctx context.Context, w io.Writer) error {
+	img, err := rep.render(ctx)
 	if err != nil {
-		err = fmt.Errorf("error rendering PNGs in parralel for dash %+v: %v", dash, err)
-		return
+		return err
 	}
-	return os.Open(fn)
+	return png.Encode(w, img)
+}
+
+// render combines the images of all panels of the dashboard into one image
+func (rep *report) render(ctx context.Context) (*image.RGBA, error) {
+	dash, err := rep.client.GetDashboard(ctx, rep.dashName)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching dashboard %v: %v", rep.dashName, err)
+	}
+	rep.dashTitle = reportTitle(dash)
+	dash = rep.opts.filterDashboard(dash)
+	if len(dash.Panels) == 0 {
+		return nil, fmt.Errorf("%w of dashboard %v", ErrNoPanelsMatch, dash.Title)
+	}
+
+	var img *image.RGBA
+	if rep.opts.ExpandVariable != "" {
+		img, err = rep.renderExpanded(ctx, dash)
+	} else {
+		img, err = rep.renderPNGsParallel(ctx, dash)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error rendering PNGs in parralel for dash %v: %w", dash.Title, err)
+	}
+	return img, nil
 }
 
 // Title returns the dashboard title parsed from the dashboard definition
 func (rep *report) Title() string {
 	//lazy fetch if Title() is called before Generate()
 	if rep.dashTitle == "" {
-		dash, err := rep.client.GetDashboard(rep.dashName)
+		dash, err := rep.client.GetDashboard(context.Background(), rep.dashName)
 		if err != nil {
 			return ""
 		}
-		rep.dashTitle = dash.Title
+		rep.dashTitle = reportTitle(dash)
 	}
 	return rep.dashTitle
 }
 
+// reportTitle returns the title of dash, naming its revision if it is not the current one
+func reportTitle(dash grafana.Dashboard) string {
+	if dash.Version == nil {
+		return dash.Title
+	}
+	return fmt.Sprintf("%s (version %d)", dash.Title, dash.Version.Version)
+}
+
 // Clean deletes the temporary directory used during report generation
 func (rep *report) Clean() {
 	err := os.RemoveAll(rep.tmpDir)
 	if err != nil {
-		log.Println("Error cleaning up tmp dir:", err)
+		slog.Error("error cleaning up tmp dir", "dir", rep.tmpDir, "error", err)
 	}
 }
 
@@ -116,56 +173,77 @@ func (rep *report) imgDirPath() string {
 	return filepath.Join(rep.tmpDir, imgDir)
 }
 
-func (rep *report) renderPNGsParallel(dash grafana.Dashboard) (string, error) {
-	//buffer all panels on a channel
-	panels := make(chan grafana.Panel, len(dash.Panels))
-	for _, p := range dash.Panels {
-		panels <- p
+// outputPath is the file the combined image is written to, inside the temporary directory of the report
+// so that reports of the same dashboard generated at the same time do not overwrite each other
+func (rep *report) outputPath() string {
+	return filepath.Join(rep.tmpDir, outputFile)
+}
+
+// section returns a report rendering the panels of dashName into its own sub directory,
+// as panel image files are named by panel id
+func (rep *report) section(dashName string, i int) *report {
+	return &report{
+		client:    rep.client,
+		time:      rep.time,
+		dashName:  dashName,
+		dashTitle: rep.dashTitle,
+		tmpDir:    filepath.Join(rep.tmpDir, strconv.Itoa(i)),
+		worker:    rep.worker,
+		opts:      rep.opts,
+		inMemory:  rep.inMemory,
+	}
+}
+
+func (rep *report) renderPNGsParallel(ctx context.Context, dash grafana.Dashboard) (*image.RGBA, error) {
+	images, err := rep.renderPanels(ctx, dash)
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := headerCaption(dash); ok {
+		return processSections([]caption{c}, [][]*imageData{images})
+	}
+	return processImages(images)
+}
+
+// renderPanels fetches the images of all panels of dash from the Grafana server,
+// in the order of the panels and with repeated panels laid out as Grafana would
+func (rep *report) renderPanels(ctx context.Context, dash grafana.Dashboard) ([]*imageData, error) {
+	//buffer all panel positions on a channel
+	panels := make(chan int, len(dash.Panels))
+	for i := range dash.Panels {
+		panels <- i
 	}
 	close(panels)
 	images := make([]*imageData, len(dash.Panels))
+	names := imageFileNames(dash.Panels)
+
+	rep.opts.Progress.add(len(dash.Panels))
 
 	//fetch images in parrallel form Grafana sever.
 	//limit concurrency using a worker pool to avoid overwhelming grafana
 	//for dashboards with many panels.
-	var j uint64
 	var wg sync.WaitGroup
 	wg.Add(rep.worker)
 	errs := make(chan error, len(dash.Panels)) //routines can return errors on a channel
 	for i := 0; i < rep.worker; i++ {
-		go func(panels <-chan grafana.Panel, errs chan<- error) {
+		go func(panels <-chan int, errs chan<- error) {
 			defer wg.Done()
-			for p := range panels {
-				filename, err := rep.renderPNG(p)
-				if err != nil {
-					log.Printf("Error creating image for panel: %v", err)
-					errs <- err
-					continue
-				}
-				fimg, err := os.Open(filename)
-				if err != nil {
-					log.Println("Unable to open file", filename)
-					errs <- err
-					continue
-				}
-				defer fimg.Close()
-				// Decode the file to get the image data
-				img, _, err := image.Decode(fimg)
-				if err != nil {
-					log.Println("Unable to decode ", filename)
-					errs <- err
-					continue
+			for i := range panels {
+				start := time.Now()
+				var imd *imageData
+				var err error
+				if rep.inMemory {
+					imd, err = rep.decodePanel(ctx, dash.Panels[i])
+				} else {
+					imd, err = rep.loadPanel(ctx, dash.Panels[i], names[i])
 				}
-				// Fill image data object
-				imd, err := getImageData(&img, filename)
+				metrics.ObservePanel(time.Since(start), err)
+				rep.opts.Progress.panelDone(dash.Panels[i], err)
 				if err != nil {
-					log.Println(err)
 					errs <- err
 					continue
 				}
-				// Append to imadeData array
-				images[atomic.LoadUint64(&j)] = &imd
-				atomic.AddUint64(&j, 1)
+				images[i] = imd
 			}
 		}(panels, errs)
 
@@ -175,17 +253,61 @@ func (rep *report) renderPNGsParallel(dash grafana.Dashboard) (string, error) {
 
 	for err := range errs {
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 	}
 
-	return processImages(images, dash.Title)
+	return layoutRows(dash, images), nil
 }
 
-func (rep *report) renderPNG(p grafana.Panel) (string, error) {
-	body, err := rep.client.GetPanelPng(p, rep.dashName, rep.time)
+// loadPanel renders p into the file imgFileName and decodes it
+func (rep *report) loadPanel(ctx context.Context, p grafana.Panel, imgFileName string) (*imageData, error) {
+	filename, err := rep.renderPNG(ctx, p, imgFileName)
 	if err != nil {
-		return "", fmt.Errorf("error getting panel %+v: %v", p, err)
+		slog.ErrorContext(ctx, "error creating image for panel", "panel", p.ID, "error", err)
+		return nil, err
+	}
+	fimg, err := os.Open(filename)
+	if err != nil {
+		slog.ErrorContext(ctx, "unable to open file", "file", filename, "error", err)
+		return nil, err
+	}
+	defer fimg.Close()
+	// Decode the file to get the image data
+	img, _, err := image.Decode(fimg)
+	if err != nil {
+		slog.ErrorContext(ctx, "unable to decode image", "file", filename, "error", err)
+		return nil, err
+	}
+	// Fill image data object
+	imd, err := getImageData(&img, filename)
+	if err != nil {
+		slog.ErrorContext(ctx, "unable to read image dimensions", "file", filename, "error", err)
+		return nil, err
+	}
+	return &imd, nil
+}
+
+// imageFileNames names the image file of each panel after the panel id. Panels rendered more than once,
+// e.g. repeated panels, are told apart by their position.
+func imageFileNames(panels []grafana.Panel) []string {
+	names := make([]string, len(panels))
+	seen := make(map[int]bool)
+	for i, p := range panels {
+		if seen[p.ID] {
+			names[i] = fmt.Sprintf("image%d_%d.png", p.ID, i)
+		} else {
+			names[i] = fmt.Sprintf("image%d.png", p.ID)
+		}
+		seen[p.ID] = true
+	}
+	return names
+}
+
+func (rep *report) renderPNG(ctx context.Context, p grafana.Panel, imgFileName string) (string, error) {
+	body, err := rep.client.GetPanelPng(ctx, p, rep.dashName, rep.time)
+	if err != nil {
+		return "", fmt.Errorf("error getting panel %d %q: %w", p.ID, p.Title, err)
 	}
 	defer body.Close()
 
@@ -194,7 +316,6 @@ func (rep *report) renderPNG(p grafana.Panel) (string, error) {
 		return "", fmt.Errorf("error creating img directory:%v", err)
 	}
 
-	imgFileName := fmt.Sprintf("image%d.png", p.ID)
 	file, err := os.Create(filepath.Join(rep.imgDirPath(), imgFileName))
 	if err != nil {
 		return "", fmt.Errorf("error creating image file:%v", err)
@@ -276,31 +397,51 @@ func getMaxDim(images []*imageData) (int, int, error) {
 	return maxh, maxw, nil
 }
 
+// processSections stacks sections of images, each under its caption, into one image
+func processSections(captions []caption, sections [][]*imageData) (*image.RGBA, error) {
+	_, width, err := getMaxDim(flatten(sections))
+	if err != nil {
+		return nil, err
+	}
+	if width == 0 {
+		width = defaultCaptionWidth
+	}
+	var images []*imageData
+	for i, section := range sections {
+		images = append(images, captions[i].image(width))
+		images = append(images, section...)
+	}
+	return processImages(images)
+}
+
+func flatten(sections [][]*imageData) []*imageData {
+	var images []*imageData
+	for _, s := range sections {
+		images = append(images, s...)
+	}
+	return images
+}
+
 // processImages function to loop through all images in the imageData array
 // and calculate the total height, width and max height, width.
 // Finally calls makeImage to create the image
-// Takes the array of imageData, format and side as arguments
-func processImages(images []*imageData, outfile string) (f string, err error) {
+// Takes the array of imageData as argument
+func processImages(images []*imageData) (*image.RGBA, error) {
 	th, tw, err := getTotalDim(images)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	maxh, maxw, err := getMaxDim(images)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	// Create the output image
-	f, err = makeImage(th, tw, maxh, maxw, images, outfile)
-	if err != nil {
-		return "", err
-	}
-	return f, nil
+	return makeImage(th, tw, maxh, maxw, images), nil
 }
 
 // makeImage function to create the combined image from all the input images
-// Takes total height, width, max height, width, input images, format to
-// encode. Returns error if any
-func makeImage(th, tw, maxh, maxw int, images []*imageData, outfile string) (string, error) {
+// Takes total height, width, max height, width and the input images
+func makeImage(th, tw, maxh, maxw int, images []*imageData) *image.RGBA {
 	var img *image.RGBA
 	posx, posy := 0, 0
 
@@ -310,9 +451,33 @@ func makeImage(th, tw, maxh, maxw int, images []*imageData, outfile string) (str
 		draw.Draw(img, r, imd.img, image.Point{0, 0}, draw.Over)
 		posy = posy + imd.height
 	}
+	return img
+}
+
+// openImage returns the png encoding of img, encoded in memory or written to outfile and reopened
+func openImage(img *image.RGBA, inMemory bool, outfile string) (io.ReadCloser, error) {
+	if inMemory {
+		var buf bytes.Buffer
+		err := png.Encode(&buf, img)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(&buf), nil
+	}
+	fn, err := writeImage(img, outfile)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(fn)
+}
 
-	file := outfile + ".png"
-	out, err := os.Create(file)
+// writeImage encodes img to the png file outfile
+func writeImage(img *image.RGBA, outfile string) (string, error) {
+	err := os.MkdirAll(filepath.Dir(outfile), 0777)
+	if err != nil {
+		return "", fmt.Errorf("error creating output directory:%v", err)
+	}
+	out, err := os.Create(outfile)
 	if err != nil {
 		return "", err
 	}
@@ -323,5 +488,5 @@ func makeImage(th, tw, maxh, maxw int, images []*imageData, outfile string) (str
 		return "", err
 	}
 
-	return file, nil
+	return outfile, nil
 }
@@ -18,15 +18,21 @@ package report
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"image"
+	"image/png"
 	"io"
 	"io/ioutil"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 
-	"github.com/JaySeek/grafpng/grafana"
+	"grafpng/grafana"
+
 	"github.com/pborman/uuid"
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -61,15 +67,19 @@ type mockGrafanaClient struct {
 	variables         url.Values
 }
 
-func (m *mockGrafanaClient) GetDashboard(dashName string) (grafana.Dashboard, error) {
+func (m *mockGrafanaClient) GetDashboard(ctx context.Context, dashName string) (grafana.Dashboard, error) {
 	return grafana.NewDashboard([]byte(dashJSON), m.variables), nil
 }
 
-func (m *mockGrafanaClient) GetPanelPng(p grafana.Panel, dashName string, t grafana.TimeRange) (io.ReadCloser, error) {
+func (m *mockGrafanaClient) GetPanelPng(ctx context.Context, p grafana.Panel, dashName string, t grafana.TimeRange) (io.ReadCloser, error) {
 	m.getPanelCallCount++
 	return ioutil.NopCloser(bytes.NewBuffer([]byte("Not actually a png"))), nil
 }
 
+func (m *mockGrafanaClient) SearchDashboards(ctx context.Context, q grafana.SearchQuery) ([]grafana.SearchResult, error) {
+	return nil, nil
+}
+
 func TestReport(t *testing.T) {
 	Convey("When generating a report", t, func() {
 		variables := url.Values{}
@@ -86,8 +96,8 @@ func TestReport(t *testing.T) {
 		defer rep.Clean()
 
 		Convey("When rendering images", func() {
-			dashboard, _ := gClient.GetDashboard("")
-			rep.renderPNGsParallel(dashboard)
+			dashboard, _ := gClient.GetDashboard(context.Background(), "")
+			rep.renderPNGsParallel(context.Background(), dashboard)
 
 			Convey("It should create a temporary folder", func() {
 				_, err := os.Stat(rep.tmpDir)
@@ -127,17 +137,23 @@ type errClient struct {
 	variables         url.Values
 }
 
-func (e *errClient) GetDashboard(dashName string) (grafana.Dashboard, error) {
+func (e *errClient) GetDashboard(ctx context.Context, dashName string) (grafana.Dashboard, error) {
 	return grafana.NewDashboard([]byte(dashJSON), e.variables), nil
 }
 
-//Produce an error on the 2nd panel fetched
-func (e *errClient) GetPanelPng(p grafana.Panel, dashName string, t grafana.TimeRange) (io.ReadCloser, error) {
+//Produce an error on the 2nd panel fetched, all other panels are valid images
+func (e *errClient) GetPanelPng(ctx context.Context, p grafana.Panel, dashName string, t grafana.TimeRange) (io.ReadCloser, error) {
 	e.getPanelCallCount++
 	if e.getPanelCallCount == 2 {
 		return nil, errors.New("The second panel has some problem")
 	}
-	return ioutil.NopCloser(bytes.NewBuffer([]byte("Not actually a png"))), nil
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 8, 4)))
+	return ioutil.NopCloser(&buf), nil
+}
+
+func (e *errClient) SearchDashboards(ctx context.Context, q grafana.SearchQuery) ([]grafana.SearchResult, error) {
+	return nil, nil
 }
 
 func TestReportErrorHandling(t *testing.T) {
@@ -155,8 +171,8 @@ func TestReportErrorHandling(t *testing.T) {
 		defer rep.Clean()
 
 		Convey("When rendering images", func() {
-			dashboard, _ := gClient.GetDashboard("")
-			_, err := rep.renderPNGsParallel(dashboard)
+			dashboard, _ := gClient.GetDashboard(context.Background(), "")
+			_, err := rep.renderPNGsParallel(context.Background(), dashboard)
 
 			Convey("It shoud call getPanelPng once per panel", func() {
 				So(gClient.getPanelCallCount, ShouldEqual, 9)
@@ -185,3 +201,55 @@ func TestReportErrorHandling(t *testing.T) {
 	})
 
 }
+
+func TestConcurrentReports(t *testing.T) {
+	Convey("When reports of the same dashboard are generated at the same time", t, func() {
+		client := repeatClient{strings.Replace(repeatDashJSON, `"Title":"Repeats"`, `"Title":"Ops/Repeats"`, 1)}
+		reps := make([]Report, 4)
+		files := make([]string, len(reps))
+		errs := make([]error, len(reps))
+		var wg sync.WaitGroup
+		for i := range reps {
+			reps[i] = NewReport(client, "repeats", grafana.TimeRange{From: "now-1h", To: "now"}, 2, Options{})
+			defer reps[i].Clean()
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				f, err := reps[i].Generate(context.Background())
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				defer f.Close()
+				files[i] = f.(*os.File).Name()
+				_, _, errs[i] = image.Decode(f)
+			}(i)
+		}
+		wg.Wait()
+
+		Convey("Each report should write a complete image into its own temporary directory", func() {
+			seen := make(map[string]bool)
+			for i, rep := range reps {
+				So(errs[i], ShouldBeNil)
+				So(filepath.Dir(files[i]), ShouldEqual, rep.(*report).tmpDir)
+				So(seen[files[i]], ShouldBeFalse)
+				seen[files[i]] = true
+			}
+		})
+
+		Convey("Nothing should be written to the working directory", func() {
+			_, err := os.Stat("Ops")
+			So(os.IsNotExist(err), ShouldBeTrue)
+			_, err = os.Stat("Ops/Repeats.png")
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("Clean() should remove the images", func() {
+			for i, rep := range reps {
+				rep.Clean()
+				_, err := os.Stat(files[i])
+				So(os.IsNotExist(err), ShouldBeTrue)
+			}
+		})
+	})
+}
@@ -0,0 +1,102 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package report
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"grafpng/metrics"
+
+	"github.com/pborman/uuid"
+)
+
+// tempDirPrefix names the temporary directories of reports, so sweeping the temp root leaves other files alone
+const tempDirPrefix = "grafpng-report-"
+
+// tempRoot is the directory the temporary directories of reports are created in
+var tempRoot = os.TempDir()
+
+// SetTempRoot makes reports create their temporary directories in dir, creating it if needed
+func SetTempRoot(dir string) error {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return fmt.Errorf("error creating temp root %v: %v", dir, err)
+	}
+	tempRoot = dir
+	return nil
+}
+
+// TempRoot returns the directory temporary files are created in
+func TempRoot() string {
+	return tempRoot
+}
+
+// newTempDir returns a new path for the temporary directory of a report
+func newTempDir() string {
+	return filepath.Join(tempRoot, tempDirPrefix+uuid.New())
+}
+
+// SweepTempDirs removes the temporary directories of reports last modified longer than olderThan ago.
+// Reports remove their directories when cleaned, these are left behind by crashes and killed processes.
+// It returns the number of directories removed.
+func SweepTempDirs(olderThan time.Duration) int {
+	return sweepTempRoot(olderThan, func(e os.DirEntry) bool {
+		return e.IsDir() && strings.HasPrefix(e.Name(), tempDirPrefix)
+	})
+}
+
+// SweepTempFiles removes the files in the temp root named with prefix, e.g. the results of report jobs,
+// last modified longer than olderThan ago. It returns the number of files removed.
+func SweepTempFiles(prefix string, olderThan time.Duration) int {
+	return sweepTempRoot(olderThan, func(e os.DirEntry) bool {
+		return e.Type().IsRegular() && strings.HasPrefix(e.Name(), prefix)
+	})
+}
+
+// sweepTempRoot removes the entries of the temp root selected by sweep and last modified longer than olderThan ago
+func sweepTempRoot(olderThan time.Duration, sweep func(os.DirEntry) bool) int {
+	entries, err := os.ReadDir(tempRoot)
+	if err != nil {
+		slog.Error("error listing temp root", "dir", tempRoot, "error", err)
+		return 0
+	}
+	removed := 0
+	for _, e := range entries {
+		if !sweep(e) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < olderThan {
+			continue
+		}
+		path := filepath.Join(tempRoot, e.Name())
+		err = os.RemoveAll(path)
+		if err != nil {
+			slog.Error("error removing orphaned temporary file", "path", path, "error", err)
+			continue
+		}
+		slog.Info("removed orphaned temporary file", "path", path, "modified", info.ModTime())
+		metrics.TempDirsRemoved.Inc()
+		removed++
+	}
+	return removed
+}
@@ -0,0 +1,93 @@
+/*
+   Copyright 2018 Vastech SA (PTY) LTD
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package report
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"grafpng/grafana"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTempDirs(t *testing.T) {
+	Convey("When reports use a configured temp root", t, func() {
+		defer func(root string) { tempRoot = root }(tempRoot)
+		root := filepath.Join(t.TempDir(), "grafpng")
+		So(SetTempRoot(root), ShouldBeNil)
+
+		Convey("It should create the temp root", func() {
+			info, err := os.Stat(root)
+			So(err, ShouldBeNil)
+			So(info.IsDir(), ShouldBeTrue)
+		})
+
+		Convey("Reports should create their directories in it", func() {
+			rep := NewReport(nil, "testDash", grafana.TimeRange{}, 1, Options{}).(*report)
+			So(filepath.Dir(rep.tmpDir), ShouldEqual, root)
+			So(strings.HasPrefix(filepath.Base(rep.tmpDir), tempDirPrefix), ShouldBeTrue)
+			bulk := NewBulkReport(nil, grafana.SearchQuery{}, grafana.TimeRange{}, 1).(*bulkReport)
+			So(filepath.Dir(bulk.tmpDir), ShouldEqual, root)
+		})
+
+		Convey("Sweeping should remove only the old report directories", func() {
+			old := time.Now().Add(-2 * time.Hour)
+			mkdir := func(name string, modified time.Time) string {
+				dir := filepath.Join(root, name)
+				So(os.MkdirAll(filepath.Join(dir, imgDir), 0o700), ShouldBeNil)
+				So(os.Chtimes(dir, modified, modified), ShouldBeNil)
+				return dir
+			}
+			orphaned := mkdir(tempDirPrefix+"orphaned", old)
+			running := mkdir(tempDirPrefix+"running", time.Now())
+			foreign := mkdir("other-service", old)
+
+			So(SweepTempDirs(time.Hour), ShouldEqual, 1)
+			_, err := os.Stat(orphaned)
+			So(os.IsNotExist(err), ShouldBeTrue)
+			_, err = os.Stat(running)
+			So(err, ShouldBeNil)
+			_, err = os.Stat(foreign)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Sweeping files should remove only the old files with the prefix", func() {
+			old := time.Now().Add(-2 * time.Hour)
+			create := func(name string, modified time.Time) string {
+				file := filepath.Join(root, name)
+				So(os.WriteFile(file, []byte("png"), 0o600), ShouldBeNil)
+				So(os.Chtimes(file, modified, modified), ShouldBeNil)
+				return file
+			}
+			orphaned := create("grafpng-job-1.png", old)
+			recent := create("grafpng-job-2.png", time.Now())
+			foreign := create("other-service.png", old)
+
+			So(SweepTempFiles("grafpng-job-", time.Hour), ShouldEqual, 1)
+			_, err := os.Stat(orphaned)
+			So(os.IsNotExist(err), ShouldBeTrue)
+			_, err = os.Stat(recent)
+			So(err, ShouldBeNil)
+			_, err = os.Stat(foreign)
+			So(err, ShouldBeNil)
+		})
+	})
+}